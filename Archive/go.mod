@@ -0,0 +1,5 @@
+// Earlier standalone versions of the script, kept for reference. Each file
+// is its own program, so they live outside the main module's ./...
+module github.com/monsieurr/multidl-ytdlp/Archive
+
+go 1.24
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	archiveFilename       = "multidl_archive.jsonl"
+	legacyArchiveFilename = "ytmp3_processed_archive.txt"
+	archiveFormat         = "multidl-archive"
+	archiveVersion        = 1
+	toolVersion           = "5.0.0"
+)
+
+// The archive is a JSON Lines file: a header line naming the format and
+// version, then one archiveEntry per completed item, appended in order.
+type archiveHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+type archiveEntry struct {
+	ID          string        `json:"id"`
+	Input       string        `json:"input"`
+	Title       string        `json:"title,omitempty"`
+	CompletedAt time.Time     `json:"completed_at,omitzero"`
+	Profile     string        `json:"profile,omitempty"`
+	Files       []archiveFile `json:"files,omitempty"`
+	ToolVersion string        `json:"tool_version,omitempty"`
+	Legacy      bool          `json:"legacy,omitempty"` // migrated from the plain-text archive
+}
+
+type archiveFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	Track  int    `json:"track,omitempty"` // chapter files only, as in outputFile
+}
+
+// describeFiles records the absolute path, size and SHA-256 of each file,
+// so the archive can later tell whether an output was moved or changed,
+// and which files are chapters.
+func describeFiles(outputs []outputFile) []archiveFile {
+	var files []archiveFile
+	for _, output := range outputs {
+		f, err := describeFile(output.Path)
+		if err != nil {
+			log.Printf("WARN: %v", err)
+		}
+		f.Track = output.Track
+		files = append(files, f)
+	}
+	return files
+}
+
+func describeFile(path string) (archiveFile, error) {
+	f := archiveFile{Path: path}
+	if abs, err := filepath.Abs(path); err == nil {
+		f.Path = abs
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return f, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, file)
+	if err != nil {
+		return f, fmt.Errorf("hashing %s: %w", path, err)
+	}
+	f.Size = n
+	f.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return f, nil
+}
+
+// Archive is the in-memory copy of the archive file. Entries keep file
+// order, duplicates included, so the legacy export can reproduce the
+// original text file.
+type Archive struct {
+	sync.Mutex
+	path     string
+	entries  []archiveEntry
+	index    map[string]int // canonical key -> latest entry
+	size     int64          // file size when entries were last synced with it
+	readonly bool           // --archive-readonly: never lock or write
+}
+
+// defaultArchivePath is the archive in the user data directory,
+// $XDG_DATA_HOME/multidl/ or its platform equivalent. It returns "" when
+// there is none.
+func defaultArchivePath() string {
+	dir, err := userDataDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, configDirName, archiveFilename)
+}
+
+// userDataDir is the data counterpart of os.UserConfigDir.
+func userDataDir() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		return dir, nil
+	}
+	switch runtime.GOOS {
+	case "windows":
+		if dir := os.Getenv("LocalAppData"); dir != "" {
+			return dir, nil
+		}
+		return "", errors.New("%LocalAppData% is not defined")
+	case "darwin", "ios":
+		return os.UserConfigDir() // ~/Library/Application Support
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share"), nil
+}
+
+// resolveArchivePath returns the --archive path, or the default one.
+func resolveArchivePath(cfg *Config) (string, error) {
+	if cfg.Archive != "" {
+		return cfg.Archive, nil
+	}
+	if path := defaultArchivePath(); path != "" {
+		return path, nil
+	}
+	return "", errors.New("no user data directory for the archive; set --archive")
+}
+
+// exeArchiveDir is where archives lived before they moved to the data
+// directory: next to the executable.
+func exeArchiveDir() string {
+	exePath, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	return filepath.Dir(exePath)
+}
+
+// initArchive loads the archive at path. A plain-text archive found at path,
+// or the legacy ytmp3_processed_archive.txt next to it, is migrated to the
+// JSON Lines format first; the original is kept with a .migrated suffix.
+// The default archive is also seeded from one next to the executable. A
+// read-only archive is only read: no locks, migrations or new files.
+func initArchive(path string, readonly bool) error {
+	processedArchive = Archive{path: path, index: make(map[string]int), readonly: readonly}
+
+	processedArchive.Lock()
+	defer processedArchive.Unlock()
+	if readonly {
+		return loadArchiveReadonly(path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	return withArchiveLock(path, func() error {
+		if err := loadArchive(path); err != nil {
+			return err
+		}
+		processedArchive.syncSize()
+		return nil
+	})
+}
+
+// loadArchiveReadonly reads the archive that loadArchive would use, legacy
+// formats included, without migrating, moving or writing anything.
+func loadArchiveReadonly(path string) error {
+	src, err := archiveSource(path)
+	if err != nil || src == "" {
+		return err
+	}
+	legacy, err := isLegacyArchive(src)
+	if err != nil {
+		return err
+	}
+	var entries []archiveEntry
+	if legacy {
+		entries, err = readLegacyArchive(src)
+	} else {
+		entries, err = readArchiveFile(src)
+	}
+	if err != nil {
+		return err
+	}
+	processedArchive.setEntries(entries)
+	if src == path {
+		processedArchive.syncSize()
+	}
+	return nil
+}
+
+// archiveSource finds the file the archive at path is loaded from: path
+// itself, else for the default archive one left next to the executable,
+// else a legacy ytmp3_processed_archive.txt next to either. It returns ""
+// when there is none yet.
+func archiveSource(path string) (string, error) {
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	dirs := []string{filepath.Dir(path)}
+	if path == defaultArchivePath() {
+		if dir := exeArchiveDir(); dir != "" && dir != dirs[0] {
+			oldPath := filepath.Join(dir, archiveFilename)
+			if _, err := os.Stat(oldPath); err == nil {
+				return oldPath, nil
+			}
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		legacyPath := filepath.Join(dir, legacyArchiveFilename)
+		if _, err := os.Stat(legacyPath); err == nil {
+			return legacyPath, nil
+		}
+	}
+	return "", nil
+}
+
+func loadArchive(path string) error {
+	src, err := archiveSource(path)
+	switch {
+	case err != nil:
+		return err
+	case src == "":
+		return writeArchiveFile(path, nil)
+	case src != path && filepath.Base(src) == archiveFilename:
+		return moveArchive(src, path)
+	case src != path:
+		return migrateLegacyArchive(src, path)
+	}
+
+	legacy, err := isLegacyArchive(path)
+	if err != nil {
+		return err
+	}
+	if legacy {
+		return migrateLegacyArchive(path, path)
+	}
+	entries, err := readArchiveFile(path)
+	if err != nil {
+		return err
+	}
+	processedArchive.setEntries(entries)
+	return nil
+}
+
+// isLegacyArchive reports whether the file at path is a plain-text archive,
+// i.e. non-empty and not starting with our header line.
+func isLegacyArchive(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var header archiveHeader
+		if json.Unmarshal([]byte(line), &header) == nil && header.Format == archiveFormat {
+			return false, nil
+		}
+		return true, nil
+	}
+	return false, scanner.Err()
+}
+
+func readArchiveFile(path string) ([]archiveEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer file.Close()
+
+	var entries []archiveEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if lineNo == 1 {
+			var header archiveHeader
+			if err := json.Unmarshal([]byte(line), &header); err == nil && header.Format == archiveFormat {
+				if header.Version > archiveVersion {
+					return nil, fmt.Errorf("archive %s has version %d, this build reads up to %d", path, header.Version, archiveVersion)
+				}
+				continue
+			}
+		}
+
+		var entry archiveEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, fmt.Errorf("archive %s:%d: %w", path, lineNo, err)
+		}
+		if entry.ID == "" {
+			entry.ID = canonicalKey(entry.Input)
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("archive read error: %w", err)
+	}
+	return entries, nil
+}
+
+// writeArchiveFile replaces the archive at path with a header and entries,
+// going through a temporary file so a crash never leaves it half written.
+func writeArchiveFile(path string, entries []archiveEntry) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("archive write failed: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(archiveHeader{Format: archiveFormat, Version: archiveVersion}); err != nil {
+		tmp.Close()
+		return fmt.Errorf("archive write failed: %w", err)
+	}
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			tmp.Close()
+			return fmt.Errorf("archive write failed: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("archive write failed: %w", err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("archive write failed: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("archive write failed: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readLegacyArchive reads a plain-text archive, one input per line.
+func readLegacyArchive(path string) ([]archiveEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open legacy archive: %w", err)
+	}
+	defer file.Close()
+
+	var entries []archiveEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			entries = append(entries, archiveEntry{
+				ID:     canonicalKey(line),
+				Input:  line,
+				Legacy: true,
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("legacy archive read error: %w", err)
+	}
+	return entries, nil
+}
+
+func migrateLegacyArchive(legacyPath, path string) error {
+	entries, err := readLegacyArchive(legacyPath)
+	if err != nil {
+		return err
+	}
+
+	backup := legacyPath + ".migrated"
+	if legacyPath == path {
+		// Migrating in place overwrites the original, so keep it first.
+		if err := os.Rename(legacyPath, backup); err != nil {
+			return fmt.Errorf("failed to keep legacy archive: %w", err)
+		}
+		if err := writeArchiveFile(path, entries); err != nil {
+			os.Rename(backup, legacyPath)
+			return err
+		}
+	} else {
+		if err := writeArchiveFile(path, entries); err != nil {
+			return err
+		}
+		// From now on the new archive is found first, so an original we
+		// can't rename, say in a read-only install directory, is never
+		// migrated again.
+		if err := os.Rename(legacyPath, backup); err != nil {
+			log.Printf("WARN: migrated legacy archive to %s but left %s in place: %v", path, legacyPath, err)
+			backup = legacyPath
+		}
+	}
+
+	log.Printf("Migrated %d entries from %s to %s (original kept as %s)", len(entries), legacyPath, path, backup)
+	processedArchive.setEntries(entries)
+	return nil
+}
+
+// moveArchive copies the archive at oldPath to path, migrating it if it is
+// still plain text, and renames the original with a .migrated suffix.
+func moveArchive(oldPath, path string) error {
+	if legacy, err := isLegacyArchive(oldPath); err != nil {
+		return err
+	} else if legacy {
+		return migrateLegacyArchive(oldPath, path)
+	}
+
+	entries, err := readArchiveFile(oldPath)
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveFile(path, entries); err != nil {
+		return err
+	}
+	backup := oldPath + ".migrated"
+	if err := os.Rename(oldPath, backup); err != nil {
+		log.Printf("WARN: moved archive to %s but could not rename the original: %v", path, err)
+		backup = oldPath
+	}
+
+	log.Printf("Moved %d archive entries from %s to %s (original kept as %s)", len(entries), oldPath, path, backup)
+	processedArchive.setEntries(entries)
+	return nil
+}
+
+func (a *Archive) setEntries(entries []archiveEntry) {
+	a.entries = entries
+	a.index = make(map[string]int, len(entries))
+	for i, entry := range entries {
+		a.index[entry.ID] = i
+	}
+}
+
+// syncSize records the archive file's current size; refresh compares
+// against it to notice entries written by other processes.
+func (a *Archive) syncSize() {
+	if info, err := os.Stat(a.path); err == nil {
+		a.size = info.Size()
+	}
+}
+
+// refresh reloads the archive if another process changed the file since we
+// last read or wrote it.
+func (a *Archive) refresh() error {
+	a.Lock()
+	defer a.Unlock()
+
+	info, err := os.Stat(a.path)
+	if a.readonly && errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil || info.Size() == a.size {
+		return err
+	}
+	reload := func() error {
+		entries, err := readArchiveFile(a.path)
+		if err != nil {
+			return err
+		}
+		a.setEntries(entries)
+		a.syncSize()
+		return nil
+	}
+	if a.readonly {
+		return loadArchiveReadonly(a.path)
+	}
+	return withArchiveLock(a.path, reload)
+}
+
+func (a *Archive) has(key string) bool {
+	a.Lock()
+	defer a.Unlock()
+	_, exists := a.index[key]
+	return exists
+}
+
+// files returns the output files recorded for key, if any.
+func (a *Archive) files(key string) []archiveFile {
+	a.Lock()
+	defer a.Unlock()
+	i, exists := a.index[key]
+	if !exists {
+		return nil
+	}
+	return a.entries[i].Files
+}
+
+func appendToArchive(path string, entry archiveEntry) error {
+	processedArchive.Lock()
+	defer processedArchive.Unlock()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("archive encode failed: %w", err)
+	}
+
+	return withArchiveLock(path, func() error {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("archive open failed: %w", err)
+		}
+		defer file.Close()
+
+		if _, err := file.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("archive write failed: %w", err)
+		}
+
+		// Only skip a reload if nobody else appended since we last looked.
+		if info, err := file.Stat(); err == nil && info.Size() == processedArchive.size+int64(len(line)+1) {
+			processedArchive.size = info.Size()
+			processedArchive.entries = append(processedArchive.entries, entry)
+			processedArchive.index[entry.ID] = len(processedArchive.entries) - 1
+			return nil
+		}
+		entries, err := readArchiveFile(path)
+		if err != nil {
+			return err
+		}
+		processedArchive.setEntries(entries)
+		processedArchive.syncSize()
+		return nil
+	})
+}
+
+// rewriteArchive replaces the archive's entries with edit(entries). It takes
+// the same locks as appendToArchive and re-reads the file first, so entries
+// appended by a running download batch are not lost.
+func rewriteArchive(path string, edit func([]archiveEntry) []archiveEntry) error {
+	processedArchive.Lock()
+	defer processedArchive.Unlock()
+
+	return withArchiveLock(path, func() error {
+		entries, err := readArchiveFile(path)
+		if err != nil {
+			return err
+		}
+		entries = edit(entries)
+		if err := writeArchiveFile(path, entries); err != nil {
+			return err
+		}
+		processedArchive.setEntries(entries)
+		processedArchive.syncSize()
+		return nil
+	})
+}
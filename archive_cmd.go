@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func printArchiveUsage() {
+	prog := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, `
+Usage: %s archive [--config PATH] [--archive PATH] COMMAND [OPTIONS]
+
+Shared options such as --config and --archive may also follow the command.
+
+Commands:
+  list                      List every archived item
+  grep PATTERN              List items whose id, input, title or files match
+                            the regular expression PATTERN (case-insensitive)
+  rm ID...                  Remove items so they are downloaded again; IDs may
+                            be canonical keys or any URL form of the item
+  prune --missing-files     Remove items with a recorded output file that no
+                            longer exists (-n to only show what would go)
+  stats                     Summarize the archive
+  export --legacy [-o FILE] Write the archive in the old plain-text format
+`, prog)
+}
+
+func runArchiveCommand(args []string) int {
+	if len(args) == 0 {
+		printArchiveUsage()
+		return exitUsage
+	}
+
+	// The archive location comes from the config file, the environment and
+	// the shared options (--config, --archive, ...), before or after the
+	// command.
+	configArgs, args := splitConfigFlags(args)
+	cfg, err := loadConfig(configArgs)
+	if errors.Is(err, flag.ErrHelp) {
+		printArchiveUsage()
+		return exitOK
+	}
+	if err != nil {
+		log.Printf("FATAL: %v", err)
+		return exitUsage
+	}
+	if len(args) == 0 {
+		printArchiveUsage()
+		return exitUsage
+	}
+
+	// Only rm and prune change the archive. The others read it like
+	// --archive-readonly does, so they neither migrate, move nor lock it.
+	command := args[0]
+	var writes bool
+	switch command {
+	case "list", "grep", "stats", "export":
+	case "rm", "prune":
+		writes = true
+	default:
+		printArchiveUsage()
+		return exitUsage
+	}
+	if writes && cfg.ArchiveReadonly {
+		log.Printf("FATAL: archive %s: the archive is read-only (--archive-readonly)", command)
+		return exitUsage
+	}
+
+	path, err := resolveArchivePath(cfg)
+	if err != nil {
+		log.Printf("FATAL: %v", err)
+		return exitUsage
+	}
+	if err := initArchive(path, !writes); err != nil {
+		log.Printf("FATAL: Archive initialization failed: %v", err)
+		return exitUsage
+	}
+
+	var cmdErr error
+	switch command {
+	case "list":
+		cmdErr = archiveList(args[1:])
+	case "grep":
+		cmdErr = archiveGrep(args[1:])
+	case "rm":
+		cmdErr = archiveRemove(path, args[1:])
+	case "prune":
+		cmdErr = archivePrune(path, args[1:])
+	case "stats":
+		cmdErr = archiveStats(path, args[1:])
+	case "export":
+		cmdErr = archiveExport(args[1:])
+	}
+
+	var usage usageError
+	switch {
+	case cmdErr == nil:
+		return exitOK
+	case errors.Is(cmdErr, flag.ErrHelp):
+		return exitOK
+	case errors.As(cmdErr, &usage):
+		log.Printf("FATAL: archive %s: %v", command, cmdErr)
+		return exitUsage
+	}
+	log.Printf("FATAL: archive %s: %v", command, cmdErr)
+	return exitPartial
+}
+
+// usageError is a mistake in a subcommand's arguments, as opposed to a
+// failure carrying it out; only the former exits with exitUsage.
+type usageError struct{ error }
+
+func usageErrorf(format string, args ...any) error {
+	return usageError{fmt.Errorf(format, args...)}
+}
+
+// parseSubcommandFlags parses a subcommand's own flags, marking bad ones
+// as usage errors. The flag package has already printed what was wrong.
+func parseSubcommandFlags(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		return usageError{err}
+	}
+	return err
+}
+
+// splitConfigFlags separates the shared --config and --<setting> options,
+// which subcommands accept anywhere, from the subcommand's own arguments.
+// Only the long forms are taken, as short ones like -n and -o mean
+// something else to the subcommands.
+func splitConfigFlags(args []string) (configArgs, rest []string) {
+	isBool := map[string]bool{"config": false}
+	for _, s := range settings {
+		isBool[s.flagName()] = s.isBool()
+	}
+	for i := 0; i < len(args); i++ {
+		name, ok := strings.CutPrefix(args[i], "--")
+		name, _, hasValue := strings.Cut(name, "=")
+		boolFlag, known := isBool[name]
+		if !ok || !known {
+			rest = append(rest, args[i])
+			continue
+		}
+		configArgs = append(configArgs, args[i])
+		if !hasValue && !boolFlag && i+1 < len(args) {
+			i++
+			configArgs = append(configArgs, args[i])
+		}
+	}
+	return configArgs, rest
+}
+
+// snapshotEntries copies the entries under the archive lock.
+func snapshotEntries() []archiveEntry {
+	processedArchive.Lock()
+	defer processedArchive.Unlock()
+	return slices.Clone(processedArchive.entries)
+}
+
+func archiveList(args []string) error {
+	if len(args) != 0 {
+		return usageErrorf("unexpected arguments: %s", strings.Join(args, " "))
+	}
+	printEntries(snapshotEntries())
+	return nil
+}
+
+func archiveGrep(args []string) error {
+	if len(args) != 1 {
+		return usageErrorf("expected exactly one PATTERN")
+	}
+	re, err := regexp.Compile("(?i)" + args[0])
+	if err != nil {
+		return usageError{err}
+	}
+
+	var matches []archiveEntry
+	for _, entry := range snapshotEntries() {
+		if entryMatches(entry, re) {
+			matches = append(matches, entry)
+		}
+	}
+	printEntries(matches)
+	return nil
+}
+
+func entryMatches(entry archiveEntry, re *regexp.Regexp) bool {
+	if re.MatchString(entry.ID) || re.MatchString(entry.Input) || re.MatchString(entry.Title) {
+		return true
+	}
+	for _, f := range entry.Files {
+		if re.MatchString(f.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+func printEntries(entries []archiveEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COMPLETED\tID\tPROFILE\tTITLE/INPUT")
+	for _, entry := range entries {
+		completed := "-"
+		if !entry.CompletedAt.IsZero() {
+			completed = entry.CompletedAt.Local().Format("2006-01-02 15:04")
+		}
+		profile := entry.Profile
+		if profile == "" {
+			profile = "-"
+		}
+		label := entry.Title
+		if label == "" {
+			label = entry.Input
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", completed, entry.ID, profile, label)
+	}
+	w.Flush()
+}
+
+func archiveRemove(path string, args []string) error {
+	if len(args) == 0 {
+		return usageErrorf("expected at least one ID")
+	}
+
+	remove := make(map[string]string, len(args))
+	for _, arg := range args {
+		remove[canonicalKey(arg)] = arg
+	}
+
+	removed := make(map[string]int)
+	err := rewriteArchive(path, func(entries []archiveEntry) []archiveEntry {
+		return slices.DeleteFunc(entries, func(entry archiveEntry) bool {
+			if _, ok := remove[entry.ID]; ok {
+				removed[entry.ID]++
+				return true
+			}
+			return false
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(remove)) {
+		if n := removed[key]; n > 0 {
+			fmt.Printf("Removed %s (%d entries)\n", key, n)
+		} else {
+			log.Printf("WARN: %s (%s) is not in the archive", remove[key], key)
+		}
+	}
+	return nil
+}
+
+func archivePrune(path string, args []string) error {
+	fs := flag.NewFlagSet("archive prune", flag.ContinueOnError)
+	missingFiles := fs.Bool("missing-files", false, "remove items with a recorded output file that no longer exists")
+	dryRun := fs.Bool("n", false, "only show what would be removed")
+	if err := parseSubcommandFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usageErrorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if !*missingFiles {
+		return usageErrorf("nothing to prune by; use --missing-files")
+	}
+
+	missing := func(entry archiveEntry) bool {
+		for _, f := range entry.Files {
+			if _, err := os.Stat(f.Path); errors.Is(err, os.ErrNotExist) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var pruned []archiveEntry
+	edit := func(entries []archiveEntry) []archiveEntry {
+		return slices.DeleteFunc(entries, func(entry archiveEntry) bool {
+			if missing(entry) {
+				pruned = append(pruned, entry)
+				return true
+			}
+			return false
+		})
+	}
+
+	if *dryRun {
+		edit(snapshotEntries())
+	} else if err := rewriteArchive(path, edit); err != nil {
+		return err
+	}
+
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	for _, entry := range pruned {
+		fmt.Printf("%s %s (%s)\n", verb, entry.ID, entry.Input)
+	}
+	fmt.Printf("%s %d entries with missing files\n", verb, len(pruned))
+	return nil
+}
+
+func archiveStats(path string, args []string) error {
+	if len(args) != 0 {
+		return usageErrorf("unexpected arguments: %s", strings.Join(args, " "))
+	}
+	entries := snapshotEntries()
+
+	unique := make(map[string]struct{}, len(entries))
+	profiles := make(map[string]int)
+	var legacy, files int
+	var bytes int64
+	var first, last time.Time
+	for _, entry := range entries {
+		unique[entry.ID] = struct{}{}
+		if entry.Legacy {
+			legacy++
+		}
+		profile := entry.Profile
+		if profile == "" {
+			profile = "(unknown)"
+		}
+		profiles[profile]++
+		files += len(entry.Files)
+		for _, f := range entry.Files {
+			bytes += f.Size
+		}
+		if t := entry.CompletedAt; !t.IsZero() {
+			if first.IsZero() || t.Before(first) {
+				first = t
+			}
+			if t.After(last) {
+				last = t
+			}
+		}
+	}
+
+	fmt.Printf("Archive:         %s\n", path)
+	fmt.Printf("Entries:         %d (%d unique items)\n", len(entries), len(unique))
+	fmt.Printf("Migrated legacy: %d\n", legacy)
+	fmt.Printf("Output files:    %d (%s)\n", files, formatBytes(bytes))
+	if !first.IsZero() {
+		fmt.Printf("First completed: %s\n", first.Local().Format("2006-01-02 15:04"))
+		fmt.Printf("Last completed:  %s\n", last.Local().Format("2006-01-02 15:04"))
+	}
+	fmt.Println("By profile:")
+	for _, name := range slices.Sorted(maps.Keys(profiles)) {
+		fmt.Printf("  %-14s %d\n", name, profiles[name])
+	}
+	return nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// archiveExport writes the archive back out as the old one-input-per-line
+// text file.
+func archiveExport(args []string) error {
+	fs := flag.NewFlagSet("archive export", flag.ContinueOnError)
+	legacy := fs.Bool("legacy", false, "write the plain-text format used by ytmp3_processed_archive.txt")
+	output := fs.String("o", "", "write to FILE instead of stdout")
+	if err := parseSubcommandFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usageErrorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if !*legacy {
+		return usageErrorf("only --legacy export is supported")
+	}
+
+	var w io.Writer = os.Stdout
+	var file *os.File
+	if *output != "" {
+		var err error
+		if file, err = os.Create(*output); err != nil {
+			return err
+		}
+		w = file
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, entry := range snapshotEntries() {
+		input := entry.Input
+		if input == "" {
+			input = entry.ID
+		}
+		fmt.Fprintln(bw, input)
+	}
+	err := bw.Flush()
+	if file != nil {
+		// A failed close can mean the data never reached the disk.
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestMigrateLegacyArchiveKeepsOriginal checks that a legacy archive that
+// can't be renamed after migration doesn't stop the run, and isn't
+// migrated again by the next one.
+func TestMigrateLegacyArchiveKeepsOriginal(t *testing.T) {
+	dir := t.TempDir()
+	legacyPath := filepath.Join(dir, legacyArchiveFilename)
+	if err := os.WriteFile(legacyPath, []byte("h8htSF9X5sE\nhttps://youtu.be/pIwRg6rb1cI\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A non-empty directory where the backup would go makes the rename fail.
+	if err := os.MkdirAll(filepath.Join(legacyPath+".migrated", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "archive.jsonl")
+	for run := 1; run <= 2; run++ {
+		if err := initArchive(path, false); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		if n := len(snapshotEntries()); n != 2 {
+			t.Errorf("run %d: %d entries, want 2", run, n)
+		}
+		if !processedArchive.has("youtube:pIwRg6rb1cI") {
+			t.Errorf("run %d: migrated entry missing", run)
+		}
+	}
+	if _, err := os.Stat(legacyPath); err != nil {
+		t.Errorf("legacy archive not left in place: %v", err)
+	}
+}
+
+// TestArchivedTracks checks that an item archived in "both" chapter mode
+// lists its chapter files but not the whole file they were cut from.
+func TestArchivedTracks(t *testing.T) {
+	dir := t.TempDir()
+	var outputs []outputFile
+	for i, name := range []string{"Mix.mp3", "Mix/01 - Intro.mp3", "Mix/02 - Outro.mp3", "Mix/Mix.m3u8"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f := outputFile{Path: path}
+		if i == 1 || i == 2 {
+			f.Track, f.Tracks = i, 2
+		}
+		outputs = append(outputs, f)
+	}
+
+	path := filepath.Join(dir, "archive.jsonl")
+	if err := initArchive(path, false); err != nil {
+		t.Fatal(err)
+	}
+	key := "youtube:h8htSF9X5sE"
+	if err := appendToArchive(path, archiveEntry{ID: key, Input: "h8htSF9X5sE", Files: describeFiles(outputs)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, track := range archivedTracks(key) {
+		got = append(got, filepath.Base(track.Path))
+	}
+	if want := []string{"01 - Intro.mp3", "02 - Outro.mp3"}; !slices.Equal(got, want) {
+		t.Errorf("archivedTracks = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Local audio steps profiles can list in postprocess. They run after
+// yt-dlp and chapter splitting, on every media file of the item.
+const (
+	stepNormalize   = "normalize"    // two-pass EBU R128 loudnorm, re-encodes
+	stepReplayGain  = "replaygain"   // ReplayGain tags, audio untouched
+	stepTrimSilence = "trim-silence" // cut leading and trailing silence
+	stepFade        = "fade"         // fade in and out
+)
+
+const (
+	defaultLoudnessTarget   = -16 // LUFS
+	defaultSilenceThreshold = -50 // dB
+	defaultFadeDuration     = time.Second
+	loudnessTruePeak        = -1.5 // dBTP
+	loudnessRange           = 11   // LU
+	minSilence              = 0.5  // seconds of silence before it counts
+	audioTimeout            = 30 * time.Minute
+)
+
+// audioSlots bounds how many files the audio steps work on at once. They
+// are CPU-bound, unlike downloads, so they get their own limit, and items
+// wait for it apart from the download workers.
+var audioSlots chan struct{}
+
+func defaultAudioJobs() int {
+	return runtime.NumCPU()
+}
+
+// audioEncoders are the encoder arguments used when a step has to
+// re-encode, by file extension. Other streams, such as cover art, are
+// copied.
+var audioEncoders = map[string][]string{
+	".mp3":  {"-c:a", "libmp3lame"}, // plus the audio quality, see mp3Quality
+	".opus": {"-c:a", "libopus", "-b:a", "160k"},
+	".ogg":  {"-c:a", "libvorbis", "-q:a", "6"},
+	".webm": {"-c:a", "libopus", "-b:a", "160k"},
+	".m4a":  {"-c:a", "aac", "-b:a", "256k"},
+	".mp4":  {"-c:a", "aac", "-b:a", "256k"},
+	".mkv":  {"-c:a", "aac", "-b:a", "256k"},
+	".flac": {"-c:a", "flac"},
+	".wav":  {"-c:a", "pcm_s16le"},
+}
+
+func checkAudioSettings(cfg *Config) error {
+	if cfg.AudioJobs < 1 {
+		return fmt.Errorf("audio_jobs: must be at least 1")
+	}
+	if cfg.FadeDuration < 0 {
+		return fmt.Errorf("fade_duration: must not be negative")
+	}
+	for _, p := range cfg.Profiles {
+		if p.hasStep(stepNormalize) && p.hasStep(stepReplayGain) {
+			return fmt.Errorf("profile %q: normalize and replaygain are alternatives, list only one", p.Name)
+		}
+		if p.FadeDuration != nil && *p.FadeDuration < 0 {
+			return fmt.Errorf("profile %q: fade_duration must not be negative", p.Name)
+		}
+	}
+	return nil
+}
+
+// profileValue is the profile's own value for a setting if it has one,
+// else the global one.
+func profileValue[T any](own *T, global T) T {
+	if own != nil {
+		return *own
+	}
+	return global
+}
+
+// hasAudioSteps reports whether the profile lists any local audio step.
+func (p *Profile) hasAudioSteps() bool {
+	return p.hasStep(stepNormalize) || p.hasStep(stepReplayGain) || p.hasStep(stepTrimSilence) || p.hasStep(stepFade)
+}
+
+// processAudio runs the profile's audio steps on each file, at most
+// audio_jobs files at a time across all workers. Trimming changes a file's
+// duration, which is updated in files.
+func processAudio(ctx context.Context, cfg *Config, item workItem, files []outputFile) error {
+	if !item.Profile.hasAudioSteps() {
+		return nil
+	}
+	for i := range files {
+		select {
+		case audioSlots <- struct{}{}:
+		case <-ctx.Done():
+			return errKilled
+		}
+		err := processAudioFile(ctx, cfg, item.Profile, &files[i])
+		<-audioSlots
+		if ctx.Err() != nil {
+			return errKilled
+		}
+		if err != nil {
+			return fmt.Errorf("audio processing %s: %w", files[i].Path, err)
+		}
+	}
+	return nil
+}
+
+func processAudioFile(ctx context.Context, cfg *Config, profile *Profile, f *outputFile) error {
+	trim := profile.hasStep(stepTrimSilence)
+	fadeDuration := profileValue(profile.FadeDuration, cfg.FadeDuration)
+	fade := profile.hasStep(stepFade) && fadeDuration > 0
+	normalize := profile.hasStep(stepNormalize)
+
+	if trim || fade || normalize {
+		duration, _, err := probeFile(ctx, f.Path)
+		if err != nil {
+			return err
+		}
+		start, end := 0.0, duration
+		if trim {
+			threshold := profileValue(profile.SilenceThreshold, cfg.SilenceThreshold)
+			if start, end, err = detectSilence(ctx, threshold, f.Path, duration); err != nil {
+				return err
+			}
+		}
+
+		var filters []string
+		if start > 0 || end < duration {
+			filters = append(filters, fmt.Sprintf("atrim=start=%s:end=%s,asetpts=PTS-STARTPTS", formatSeconds(start), formatSeconds(end)))
+		}
+		if fade {
+			d := min(fadeDuration.Seconds(), (end-start)/2)
+			filters = append(filters,
+				fmt.Sprintf("afade=t=in:st=0:d=%s", formatSeconds(d)),
+				fmt.Sprintf("afade=t=out:st=%s:d=%s", formatSeconds(end-start-d), formatSeconds(d)))
+		}
+		if normalize {
+			target := profileValue(profile.LoudnessTarget, cfg.LoudnessTarget)
+			loudnorm, err := measureLoudness(ctx, target, f.Path, filters)
+			if err != nil {
+				return err
+			}
+			filters = append(filters, loudnorm)
+		}
+		if len(filters) > 0 {
+			if err := reencodeAudio(ctx, cfg, profile, f.Path, strings.Join(filters, ",")); err != nil {
+				return err
+			}
+			if f.Duration > 0 {
+				f.Duration = end - start
+			}
+		}
+	}
+
+	if profile.hasStep(stepReplayGain) {
+		gain, peak, err := measureReplayGain(ctx, f.Path)
+		if err != nil {
+			return err
+		}
+		return writeTags(ctx, f.Path, []string{
+			"REPLAYGAIN_TRACK_GAIN=" + gain + " dB",
+			"REPLAYGAIN_TRACK_PEAK=" + peak,
+		})
+	}
+	return nil
+}
+
+var (
+	silenceStart = regexp.MustCompile(`silence_start: (-?[\d.]+)`)
+	silenceEnd   = regexp.MustCompile(`silence_end: ([\d.]+)`)
+)
+
+// detectSilence returns the part of path to keep: from the end of any
+// leading silence to the start of any trailing silence, counting audio
+// below threshold dB as silence. A file that is silent throughout is kept
+// whole.
+func detectSilence(ctx context.Context, threshold int, path string, duration float64) (start, end float64, err error) {
+	filter := fmt.Sprintf("silencedetect=n=%ddB:d=%s", threshold, formatSeconds(minSilence))
+	out, err := runFFmpeg(ctx, "-nostdin", "-hide_banner", "-i", path, "-map", "0:a:0", "-af", filter, "-f", "null", "-")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// silencedetect logs each silence as a start line, then an end line
+	// unless the silence runs to the end of the file.
+	start, end = 0, duration
+	var lastStart float64
+	open := false
+	for _, line := range strings.Split(out, "\n") {
+		if m := silenceStart.FindStringSubmatch(line); m != nil {
+			lastStart, _ = strconv.ParseFloat(m[1], 64)
+			open = true
+		} else if m := silenceEnd.FindStringSubmatch(line); m != nil {
+			e, _ := strconv.ParseFloat(m[1], 64)
+			if lastStart <= 0.01 && start == 0 {
+				start = e
+			}
+			if e >= duration-0.01 {
+				end = lastStart
+			}
+			open = false
+		}
+	}
+	if open {
+		end = lastStart
+	}
+	if end <= start {
+		return 0, duration, nil
+	}
+	return start, end, nil
+}
+
+type loudnormStats struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// measureLoudness runs loudnorm's first pass over path, after filters,
+// and returns the second-pass loudnorm filter, aiming at target LUFS, with
+// its measurements.
+func measureLoudness(ctx context.Context, target int, path string, filters []string) (string, error) {
+	loudnorm := fmt.Sprintf("loudnorm=I=%d:TP=%.1f:LRA=%d", target, loudnessTruePeak, loudnessRange)
+	chain := strings.Join(append(filters[:len(filters):len(filters)], loudnorm+":print_format=json"), ",")
+	out, err := runFFmpeg(ctx, "-nostdin", "-hide_banner", "-i", path, "-map", "0:a:0", "-af", chain, "-f", "null", "-")
+	if err != nil {
+		return "", err
+	}
+
+	begin, end := strings.LastIndex(out, "{"), strings.LastIndex(out, "}")
+	if begin < 0 || end < begin {
+		return "", errors.New("loudnorm: no measurements")
+	}
+	var stats loudnormStats
+	if err := json.Unmarshal([]byte(out[begin:end+1]), &stats); err != nil {
+		return "", fmt.Errorf("loudnorm: bad measurements: %w", err)
+	}
+	return fmt.Sprintf("%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+		loudnorm, stats.InputI, stats.InputTP, stats.InputLRA, stats.InputThresh, stats.TargetOffset), nil
+}
+
+var (
+	trackGain = regexp.MustCompile(`track_gain = ([-+]?[\d.]+) dB`)
+	trackPeak = regexp.MustCompile(`track_peak = ([\d.]+)`)
+)
+
+// measureReplayGain returns path's ReplayGain track gain in dB and peak.
+func measureReplayGain(ctx context.Context, path string) (gain, peak string, err error) {
+	out, err := runFFmpeg(ctx, "-nostdin", "-hide_banner", "-i", path, "-map", "0:a:0", "-af", "replaygain", "-f", "null", "-")
+	if err != nil {
+		return "", "", err
+	}
+	g, p := trackGain.FindStringSubmatch(out), trackPeak.FindStringSubmatch(out)
+	if g == nil || p == nil {
+		return "", "", errors.New("replaygain: no measurements")
+	}
+	return g[1], p[1], nil
+}
+
+// reencodeAudio runs path's audio through filter and re-encodes it with
+// the encoder for its extension, at its original sample rate. Tags, cover
+// art and other streams are kept. The result replaces path only once
+// ffmpeg has succeeded.
+func reencodeAudio(ctx context.Context, cfg *Config, profile *Profile, path, filter string) error {
+	ext := strings.ToLower(filepath.Ext(path))
+	encoder, ok := audioEncoders[ext]
+	if !ok {
+		return fmt.Errorf("no audio encoder known for %s files", ext)
+	}
+	if ext == ".mp3" {
+		quality := profile.AudioQuality
+		if quality == "" {
+			quality = cfg.AudioQuality
+		}
+		encoder = append(encoder[:len(encoder):len(encoder)], mp3Quality(quality)...)
+	}
+	rate, err := sampleRate(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), ".processing-"+filepath.Base(path))
+	args := []string{"-nostdin", "-v", "error", "-y", "-i", path, "-map", "0", "-map_metadata", "0", "-c", "copy",
+		"-af", filter}
+	args = append(args, encoder...)
+	args = append(args, "-ar", rate)
+	if ext == ".mp3" {
+		args = append(args, "-id3v2_version", "4")
+	}
+	args = append(args, tmp)
+
+	if _, err := runFFmpeg(ctx, args...); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// mp3Quality turns an audio quality as yt-dlp takes it into LAME encoder
+// arguments: a bitrate such as "128K" for CBR, else a VBR quality 0-9.
+func mp3Quality(quality string) []string {
+	if rate, ok := strings.CutSuffix(strings.ToLower(quality), "k"); ok {
+		if _, err := strconv.Atoi(rate); err == nil {
+			return []string{"-b:a", rate + "k"}
+		}
+	}
+	return []string{"-q:a", quality}
+}
+
+// sampleRate returns the sample rate of path's first audio stream. loudnorm
+// upsamples to 192 kHz, so re-encoding puts it back.
+func sampleRate(ctx context.Context, path string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "a:0",
+		"-show_entries", "stream=sample_rate", "-of", "csv=p=0", path)
+	configureChildProcess(cmd)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("ffprobe: %w", err)
+	}
+	rate := strings.TrimSpace(string(out))
+	if _, err := strconv.Atoi(rate); err != nil {
+		return "", fmt.Errorf("ffprobe: no sample rate for %s", path)
+	}
+	return rate, nil
+}
+
+// runFFmpeg runs ffmpeg with args and returns what it logged, which is
+// where the analysis filters report.
+func runFFmpeg(ctx context.Context, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, audioTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	configureChildProcess(cmd)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			if msg := lastLine(string(out)); msg != "" {
+				return "", fmt.Errorf("ffmpeg: %s", msg)
+			}
+		}
+		return "", fmt.Errorf("ffmpeg: %w", err)
+	}
+	return string(out), nil
+}
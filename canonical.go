@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	youtubeKeyPrefix  = "youtube:"
+	playlistKeyPrefix = "youtube:playlist:"
+)
+
+var (
+	youtubeIDPattern  = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+	playlistIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{10,}$`)
+)
+
+// youtubeHosts are the hosts that serve the regular YouTube URL layout.
+var youtubeHosts = map[string]bool{
+	"youtube.com":              true,
+	"www.youtube.com":          true,
+	"m.youtube.com":            true,
+	"music.youtube.com":        true,
+	"youtube-nocookie.com":     true,
+	"www.youtube-nocookie.com": true,
+}
+
+// trackingParams are stripped from URLs we don't otherwise understand.
+var trackingParams = map[string]bool{
+	"t":       true,
+	"si":      true,
+	"feature": true,
+	"pp":      true,
+	"fbclid":  true,
+	"gclid":   true,
+}
+
+// canonicalKey reduces an input to the key used for deduplication, the
+// archive and the pending set. YouTube videos become youtube:<id> and
+// playlists youtube:playlist:<id>, whatever URL form they came in. A watch
+// URL that carries a list= parameter is a playlist, as that is what yt-dlp
+// downloads for it, unless the list is an auto-generated mix: those never
+// end, so the URL stays the single video. Other URLs lose their fragment
+// and tracking parameters; anything that isn't a URL (search terms and the
+// like) is only trimmed.
+func canonicalKey(identifier string) string {
+	s := strings.TrimSpace(identifier)
+	if strings.HasPrefix(s, youtubeKeyPrefix) {
+		return s
+	}
+	if youtubeIDPattern.MatchString(s) {
+		return youtubeKeyPrefix + s
+	}
+
+	raw := s
+	if !strings.Contains(raw, "://") && looksLikeYouTubeHost(raw) {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return s
+	}
+
+	host := strings.ToLower(u.Hostname())
+	query := u.Query()
+
+	switch {
+	case host == "youtu.be" || host == "www.youtu.be":
+		if id := firstPathSegment(u.Path); youtubeIDPattern.MatchString(id) {
+			if list := query.Get("list"); playlistIDPattern.MatchString(list) && !isMixList(list) {
+				return playlistKeyPrefix + list
+			}
+			return youtubeKeyPrefix + id
+		}
+	case youtubeHosts[host]:
+		if key := youtubePathKey(u.Path, query); key != "" {
+			return key
+		}
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	for param := range query {
+		if trackingParams[param] || strings.HasPrefix(param, "utm_") {
+			query.Del(param)
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func youtubePathKey(path string, query url.Values) string {
+	list := query.Get("list")
+	hasList := playlistIDPattern.MatchString(list)
+
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	switch segments[0] {
+	case "watch":
+		if hasList && !isMixList(list) {
+			return playlistKeyPrefix + list
+		}
+		if v := query.Get("v"); youtubeIDPattern.MatchString(v) {
+			return youtubeKeyPrefix + v
+		}
+	case "playlist":
+		if hasList {
+			return playlistKeyPrefix + list
+		}
+	case "shorts", "embed", "v", "live", "e":
+		if len(segments) > 1 && youtubeIDPattern.MatchString(segments[1]) {
+			return youtubeKeyPrefix + segments[1]
+		}
+	}
+	return ""
+}
+
+// isMixList reports whether list is one of YouTube's generated mixes
+// (RD... radio mixes, UL... uploads mixes) rather than a real playlist.
+func isMixList(list string) bool {
+	return strings.HasPrefix(list, "RD") || strings.HasPrefix(list, "UL")
+}
+
+func looksLikeYouTubeHost(s string) bool {
+	host, _, _ := strings.Cut(s, "/")
+	host = strings.ToLower(host)
+	return youtubeHosts[host] || host == "youtu.be" || host == "www.youtu.be"
+}
+
+func firstPathSegment(path string) string {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return segment
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestCanonicalKey(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"h8htSF9X5sE", "youtube:h8htSF9X5sE"},
+		{"  h8htSF9X5sE  ", "youtube:h8htSF9X5sE"},
+		{"youtube:h8htSF9X5sE", "youtube:h8htSF9X5sE"},
+		{"https://www.youtube.com/watch?v=h8htSF9X5sE", "youtube:h8htSF9X5sE"},
+		{"https://www.youtube.com/watch?v=h8htSF9X5sE&t=2s", "youtube:h8htSF9X5sE"},
+		{"https://www.youtube.com/watch?feature=share&v=h8htSF9X5sE", "youtube:h8htSF9X5sE"},
+		{"http://m.youtube.com/watch?v=h8htSF9X5sE", "youtube:h8htSF9X5sE"},
+		{"https://music.youtube.com/watch?v=h8htSF9X5sE&si=abc", "youtube:h8htSF9X5sE"},
+		{"www.youtube.com/watch?v=h8htSF9X5sE", "youtube:h8htSF9X5sE"},
+		{"https://youtu.be/h8htSF9X5sE", "youtube:h8htSF9X5sE"},
+		{"youtu.be/h8htSF9X5sE?si=xyz", "youtube:h8htSF9X5sE"},
+		{"https://www.youtube.com/shorts/h8htSF9X5sE", "youtube:h8htSF9X5sE"},
+		{"https://www.youtube.com/embed/h8htSF9X5sE", "youtube:h8htSF9X5sE"},
+		{"https://www.youtube-nocookie.com/embed/h8htSF9X5sE", "youtube:h8htSF9X5sE"},
+		{"https://www.youtube.com/live/h8htSF9X5sE", "youtube:h8htSF9X5sE"},
+
+		{"https://www.youtube.com/playlist?list=PLabcdefghij", "youtube:playlist:PLabcdefghij"},
+		{"https://www.youtube.com/watch?v=h8htSF9X5sE&list=PLabcdefghij", "youtube:playlist:PLabcdefghij"},
+		{"https://youtu.be/h8htSF9X5sE?list=PLabcdefghij", "youtube:playlist:PLabcdefghij"},
+
+		// Generated mixes stay the single video.
+		{"https://www.youtube.com/watch?v=h8htSF9X5sE&list=RDh8htSF9X5sE", "youtube:h8htSF9X5sE"},
+		{"https://www.youtube.com/watch?v=h8htSF9X5sE&list=ULh8htSF9X5sE", "youtube:h8htSF9X5sE"},
+		{"https://youtu.be/h8htSF9X5sE?list=RDh8htSF9X5sE", "youtube:h8htSF9X5sE"},
+
+		{"https://example.com/video?id=1&utm_source=x&t=3#frag", "https://example.com/video?id=1"},
+		{"HTTPS://Example.COM/a", "https://example.com/a"},
+		{"ytsearch:some song", "ytsearch:some song"},
+		{"not a url", "not a url"},
+	}
+	for _, tt := range tests {
+		if got := canonicalKey(tt.in); got != tt.want {
+			t.Errorf("canonicalKey(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
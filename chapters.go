@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chapter modes, for profiles with the split-chapters step.
+const (
+	chapterSplit = "split" // one file per chapter, whole file removed
+	chapterWhole = "whole" // whole file only
+	chapterBoth  = "both"  // whole file and one file per chapter
+	chapterCue   = "cue"   // whole file and a .cue sheet
+)
+
+// Where chapters come from when no chapter file is given.
+const (
+	sourceAuto        = "auto" // metadata, else description timestamps
+	sourceMetadata    = "metadata"
+	sourceDescription = "description"
+	sourceNone        = "none"
+)
+
+const splitTimeout = 10 * time.Minute
+
+func checkChapterSettings(cfg *Config) error {
+	switch cfg.ChapterMode {
+	case chapterSplit, chapterWhole, chapterBoth, chapterCue:
+	default:
+		return fmt.Errorf("chapter_mode: expected split, whole, both or cue, got %q", cfg.ChapterMode)
+	}
+	switch cfg.ChapterSource {
+	case sourceAuto, sourceMetadata, sourceDescription, sourceNone:
+	default:
+		return fmt.Errorf("chapter_source: expected auto, metadata, description or none, got %q", cfg.ChapterSource)
+	}
+	return nil
+}
+
+// chapterModeFor is the mode item is processed in. Profiles without the
+// split-chapters step always keep the whole file.
+func chapterModeFor(cfg *Config, item workItem) string {
+	if !cfg.SplitChapters || !item.Profile.hasStep("split-chapters") {
+		return chapterWhole
+	}
+	return cfg.ChapterMode
+}
+
+// timestampFirst and timestampLast match chapter lines like "01:02 Intro",
+// "[1:02:03] - Intro" or "Intro 1:02".
+var (
+	timestampFirst = regexp.MustCompile(`^(?:[-*•]\s*)?[\[(]?((?:\d{1,2}:)?\d{1,2}:\d{2})[\])]?\s*[-–—:|.]?\s*(.*)$`)
+	timestampLast  = regexp.MustCompile(`^(?:[-*•]\s*)?(.*?)\s*[-–—:|]?\s*[\[(]?((?:\d{1,2}:)?\d{1,2}:\d{2})[\])]?$`)
+)
+
+// parseTimestamp turns [H:]MM:SS into seconds.
+func parseTimestamp(s string) float64 {
+	var seconds float64
+	for _, part := range strings.Split(s, ":") {
+		n, _ := strconv.Atoi(part)
+		seconds = seconds*60 + float64(n)
+	}
+	return seconds
+}
+
+// parseChapterLines reads chapters from the first block of timestamp
+// lines in text: it starts at a line beginning with a timestamp, after
+// which "Title 1:02" lines count too. Each chapter ends where the next
+// starts, the last at duration. With strict set, as for descriptions, the
+// block ends at the first line that doesn't fit, keeping what came before,
+// and only counts if it starts at 0:00 and has at least two chapters, like
+// YouTube's own rule. Otherwise other lines are skipped and timestamps
+// that don't increase are an error.
+func parseChapterLines(text string, duration float64, strict bool) ([]chapterInfo, error) {
+	var chapters []chapterInfo
+lines:
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		var stamp, title string
+		if m := timestampFirst.FindStringSubmatch(line); m != nil {
+			stamp, title = m[1], m[2]
+		} else if m := timestampLast.FindStringSubmatch(line); m != nil && len(chapters) > 0 {
+			stamp, title = m[2], m[1]
+		}
+
+		start := parseTimestamp(stamp)
+		n := len(chapters)
+		switch {
+		case stamp == "" || duration > 0 && start >= duration:
+			if strict && n > 0 {
+				break lines
+			}
+			continue
+		case n > 0 && start <= chapters[n-1].StartTime:
+			if strict {
+				break lines
+			}
+			return nil, fmt.Errorf("timestamp %s is not after the previous one", stamp)
+		}
+		if title == "" {
+			title = fmt.Sprintf("Chapter %d", n+1)
+		}
+		chapters = append(chapters, chapterInfo{Title: title, StartTime: start})
+	}
+	if strict && (len(chapters) < 2 || chapters[0].StartTime != 0) {
+		return nil, nil
+	}
+	for i := range chapters {
+		if i+1 < len(chapters) {
+			chapters[i].EndTime = chapters[i+1].StartTime
+		} else {
+			chapters[i].EndTime = duration
+		}
+	}
+	return chapters, nil
+}
+
+// resolveChapters picks item's chapters: from its chapter file if it has
+// one, else per chapter_source.
+func resolveChapters(cfg *Config, item workItem, info *mediaInfo) ([]chapterInfo, error) {
+	if item.ChapterFile != "" {
+		data, err := os.ReadFile(item.ChapterFile)
+		if err != nil {
+			return nil, err
+		}
+		chapters, err := parseChapterLines(string(data), info.Duration, false)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", item.ChapterFile, err)
+		}
+		if len(chapters) == 0 {
+			return nil, fmt.Errorf("%s: no chapters found", item.ChapterFile)
+		}
+		return chapters, nil
+	}
+
+	switch cfg.ChapterSource {
+	case sourceMetadata:
+		return info.Chapters, nil
+	case sourceDescription:
+		return parseChapterLines(info.Description, info.Duration, true)
+	case sourceAuto:
+		if len(info.Chapters) > 0 {
+			return info.Chapters, nil
+		}
+		return parseChapterLines(info.Description, info.Duration, true)
+	}
+	return nil, nil
+}
+
+// applyChapterMode turns the whole file yt-dlp produced into what the
+// chapter mode asks for. A video without chapters is treated as a single
+// chapter, so it lands in the same layout as one with chapters. It returns
+// the media files and, separately, sidecar files such as the cue sheet.
+func applyChapterMode(ctx context.Context, cfg *Config, item workItem, info *mediaInfo, files []outputFile) (media, sidecars []outputFile, err error) {
+	mode := chapterModeFor(cfg, item)
+	if mode == chapterWhole || info == nil || len(files) == 0 {
+		return files, nil, nil
+	}
+	whole := files[0]
+
+	chapters, err := resolveChapters(cfg, item, info)
+	if err != nil {
+		return files, nil, fmt.Errorf("chapters: %w", err)
+	}
+	if len(chapters) == 0 {
+		chapters = []chapterInfo{{Title: info.Title, EndTime: whole.Duration}}
+	}
+
+	if mode == chapterCue {
+		cue := outputFile{Path: strings.TrimSuffix(whole.Path, filepath.Ext(whole.Path)) + ".cue"}
+		if err := writeCue(cue.Path, info, whole.Path, chapters); err != nil {
+			return files, nil, fmt.Errorf("cue sheet: %w", err)
+		}
+		return files, []outputFile{cue}, nil
+	}
+
+	split, err := splitChapters(ctx, cfg, item, info, whole, chapters, mode == chapterSplit)
+	if err != nil {
+		return append(files, split...), nil, err
+	}
+	if cfg.Verify {
+		if _, err := verifyOutputs(ctx, cfg, item, split); err != nil {
+			return append(files, split...), nil, err
+		}
+	}
+	if mode == chapterSplit {
+		if _, err := os.Stat(whole.Path); err == nil {
+			if err := os.Remove(whole.Path); err != nil {
+				return append(files, split...), nil, err
+			}
+		}
+		// The chapters may have gone into a directory of their own; don't
+		// leave the whole file's behind empty. Remove fails if it isn't.
+		if dir := filepath.Dir(whole.Path); dir != filepath.Clean(cfg.OutputDir) {
+			os.Remove(dir)
+		}
+		return split, nil, nil
+	}
+	return append(files, split...), nil, nil
+}
+
+// splitChapters cuts whole into one file per chapter, named by the chapter
+// template relative to the whole file's directory, so they follow the
+// output or playlist template that placed it. With move set and a single
+// chapter, the whole file is renamed instead of copied.
+func splitChapters(ctx context.Context, cfg *Config, item workItem, info *mediaInfo, whole outputFile, chapters []chapterInfo, move bool) ([]outputFile, error) {
+	_, tmpl := outputTemplates(cfg, item)
+	dir := filepath.Dir(whole.Path)
+
+	var files []outputFile
+	for i := range chapters {
+		ch := &chapters[i]
+		f := outputFile{
+			Path:     chapterPath(cfg, item, dir, tmpl, info, whole.Path, ch, i+1),
+			Duration: ch.EndTime - ch.StartTime,
+			Chapter:  ch,
+			Track:    i + 1,
+			Tracks:   len(chapters),
+		}
+		if f.Duration < 0 {
+			f.Duration = 0
+		}
+		if f.Path == whole.Path {
+			return files, fmt.Errorf("chapter_template gives chapter %d the same path as the whole file", i+1)
+		}
+		if err := os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+			return files, err
+		}
+
+		if move && len(chapters) == 1 {
+			if err := os.Rename(whole.Path, f.Path); err != nil {
+				return files, err
+			}
+		} else if err := cutChapter(ctx, whole.Path, f.Path, ch); err != nil {
+			return files, fmt.Errorf("splitting chapter %d: %w", i+1, err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// cutChapter copies ch out of src into dst without re-encoding.
+func cutChapter(ctx context.Context, src, dst string, ch *chapterInfo) error {
+	ctx, cancel := context.WithTimeout(ctx, splitTimeout)
+	defer cancel()
+
+	args := []string{"-nostdin", "-v", "error", "-y", "-ss", formatSeconds(ch.StartTime)}
+	if ch.EndTime > ch.StartTime {
+		args = append(args, "-t", formatSeconds(ch.EndTime-ch.StartTime))
+	}
+	args = append(args, "-i", src, "-map", "0", "-map_chapters", "-1", "-c", "copy", dst)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	configureChildProcess(cmd)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(dst)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			if msg := lastLine(string(out)); msg != "" {
+				return fmt.Errorf("ffmpeg: %s", msg)
+			}
+		}
+		return fmt.Errorf("ffmpeg: %w", err)
+	}
+	return nil
+}
+
+func formatSeconds(s float64) string {
+	return strconv.FormatFloat(s, 'f', 3, 64)
+}
+
+// ytdlpField matches the yt-dlp style %(name)s and %(name)0Nd fields that
+// chapter templates use.
+var ytdlpField = regexp.MustCompile(`%%|%\((\w+)\)(0?\d*)([sd])`)
+
+// chapterPath expands the chapter template for chapter number n. We cut
+// the chapters ourselves, so we also fill in the yt-dlp fields: title, id,
+// uploader, upload_date, ext, section_title, section_number, section_start
+// and section_end. Unknown fields become "NA", as in yt-dlp.
+func chapterPath(cfg *Config, item workItem, dir, tmpl string, info *mediaInfo, wholePath string, ch *chapterInfo, n int) string {
+	values := map[string]string{
+		"title":          info.Title,
+		"id":             info.ID,
+		"uploader":       info.Uploader,
+		"upload_date":    info.UploadDate,
+		"ext":            strings.TrimPrefix(filepath.Ext(wholePath), "."),
+		"section_title":  ch.Title,
+		"section_number": strconv.Itoa(n),
+		"section_start":  strconv.Itoa(int(ch.StartTime)),
+		"section_end":    strconv.Itoa(int(ch.EndTime)),
+	}
+	expanded := ytdlpField.ReplaceAllStringFunc(expandTemplate(cfg, item, dir, tmpl), func(field string) string {
+		if field == "%%" {
+			return "%"
+		}
+		m := ytdlpField.FindStringSubmatch(field)
+		value, ok := values[m[1]]
+		if !ok || value == "" {
+			return "NA"
+		}
+		if m[3] == "d" {
+			if n, err := strconv.Atoi(value); err == nil {
+				return fmt.Sprintf("%"+m[2]+"d", n)
+			}
+		}
+		return sanitizeFilename(value, cfg.WindowsFilenames, cfg.MaxFilenameLength)
+	})
+	return filepath.Clean(expanded)
+}
+
+// writeCue writes a cue sheet for audio, with one track per chapter.
+func writeCue(path string, info *mediaInfo, audio string, chapters []chapterInfo) error {
+	quote := func(s string) string { return `"` + strings.ReplaceAll(s, `"`, "'") + `"` }
+	fileType := "WAVE"
+	switch strings.ToLower(filepath.Ext(audio)) {
+	case ".mp3":
+		fileType = "MP3"
+	case ".aif", ".aiff":
+		fileType = "AIFF"
+	}
+
+	var b strings.Builder
+	if info.Uploader != "" {
+		fmt.Fprintf(&b, "PERFORMER %s\n", quote(info.Uploader))
+	}
+	fmt.Fprintf(&b, "TITLE %s\n", quote(info.Title))
+	fmt.Fprintf(&b, "FILE %s %s\n", quote(filepath.Base(audio)), fileType)
+	for i, ch := range chapters {
+		// Cue sheets count in frames of 1/75 s.
+		frames := int(ch.StartTime*75 + 0.5)
+		fmt.Fprintf(&b, "  TRACK %02d AUDIO\n", i+1)
+		fmt.Fprintf(&b, "    TITLE %s\n", quote(ch.Title))
+		if info.Uploader != "" {
+			fmt.Fprintf(&b, "    PERFORMER %s\n", quote(info.Uploader))
+		}
+		fmt.Fprintf(&b, "    INDEX 01 %02d:%02d:%02d\n", frames/75/60, frames/75%60, frames%75)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
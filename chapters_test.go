@@ -0,0 +1,149 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseChapterLines(t *testing.T) {
+	type chapter struct {
+		title      string
+		start, end float64
+	}
+	tests := []struct {
+		name     string
+		text     string
+		duration float64
+		strict   bool
+		want     []chapter
+	}{
+		{
+			name:     "leading timestamps",
+			text:     "0:00 Intro\n1:30 - Verse\n[1:02:03] Outro",
+			duration: 4000,
+			strict:   true,
+			want:     []chapter{{"Intro", 0, 90}, {"Verse", 90, 3723}, {"Outro", 3723, 4000}},
+		},
+		{
+			name:     "trailing timestamps after a leading one",
+			text:     "Tracklist:\n0:00 Intro\nVerse 1:30\nOutro - 3:00",
+			duration: 240,
+			strict:   true,
+			want:     []chapter{{"Intro", 0, 90}, {"Verse", 90, 180}, {"Outro", 180, 240}},
+		},
+		{
+			name:     "prose after the block",
+			text:     "0:00 Intro\n1:30 Verse\n\nRecorded live at 2:00",
+			duration: 240,
+			strict:   true,
+			want:     []chapter{{"Intro", 0, 90}, {"Verse", 90, 240}},
+		},
+		{
+			name:     "non-increasing line ends the block",
+			text:     "0:00 Intro\n1:30 Verse\n1:00 Again\n2:00 Never",
+			duration: 240,
+			strict:   true,
+			want:     []chapter{{"Intro", 0, 90}, {"Verse", 90, 240}},
+		},
+		{
+			name:     "only the first block",
+			text:     "0:00 Intro\n1:30 Verse\nthanks\n2:00 Later",
+			duration: 240,
+			strict:   true,
+			want:     []chapter{{"Intro", 0, 90}, {"Verse", 90, 240}},
+		},
+		{
+			name:     "prose ending in a timestamp",
+			text:     "Doors open at 7:30\nSee you there 8:00",
+			duration: 240,
+			strict:   true,
+		},
+		{
+			name:     "not from zero",
+			text:     "0:10 Intro\n1:30 Verse",
+			duration: 240,
+			strict:   true,
+		},
+		{
+			name:     "single chapter",
+			text:     "0:00 Intro",
+			duration: 240,
+			strict:   true,
+		},
+		{
+			name:     "past the end",
+			text:     "0:00 Intro\n1:30 Verse\n9:00 Bonus",
+			duration: 240,
+			strict:   true,
+			want:     []chapter{{"Intro", 0, 90}, {"Verse", 90, 240}},
+		},
+		{
+			name:     "chapter file skips other lines",
+			text:     "# my chapters\n0:05 Intro\n\n1:30\n",
+			duration: 240,
+			want:     []chapter{{"Intro", 5, 90}, {"Chapter 2", 90, 240}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chapters, err := parseChapterLines(tt.text, tt.duration, tt.strict)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []chapter
+			for _, ch := range chapters {
+				got = append(got, chapter{ch.Title, ch.StartTime, ch.EndTime})
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseChapterLinesOrder(t *testing.T) {
+	_, err := parseChapterLines("0:00 Intro\n1:30 Verse\n1:00 Again", 240, false)
+	if err == nil || !strings.Contains(err.Error(), "timestamp 1:00 is not after the previous one") {
+		t.Errorf("err = %v, want an order error", err)
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+	}{
+		{"0:00", 0},
+		{"01:02", 62},
+		{"1:02:03", 3723},
+	}
+	for _, tt := range tests {
+		if got := parseTimestamp(tt.in); got != tt.want {
+			t.Errorf("parseTimestamp(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestChapterPath(t *testing.T) {
+	cfg := &Config{OutputDir: "out"}
+	item := workItem{Profile: &Profile{}}
+	info := &mediaInfo{Title: "Live: Set", ID: "abc"}
+	ch := &chapterInfo{Title: "Intro/Outro", StartTime: 0, EndTime: 90}
+	whole := filepath.Join("out", "Mix", "1 - Live Set [abc].mp3")
+
+	tests := []struct {
+		tmpl, want string
+	}{
+		{defaultChapterTemplate, filepath.Join("out", "Mix", "Live: Set", "Intro_Outro - Live: Set.mp3")},
+		{"%(section_number)02d %(section_title)s.%(ext)s", filepath.Join("out", "Mix", "03 Intro_Outro.mp3")},
+		{"%(uploader)s/%(section_end)s%%.%(ext)s", filepath.Join("out", "Mix", "NA", "90%.mp3")},
+	}
+	for _, tt := range tests {
+		got := chapterPath(cfg, item, filepath.Dir(whole), tt.tmpl, info, whole, ch, 3)
+		if got != tt.want {
+			t.Errorf("chapterPath(%q) = %q, want %q", tt.tmpl, got, tt.want)
+		}
+	}
+}
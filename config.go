@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	defaultAudioQuality    = "0"
+	defaultOutputDir       = "."
+	defaultChapterTemplate = "%(title)s/%(section_title)s - %(title)s.%(ext)s"
+	configDirName          = "multidl"
+	configFilename         = "config.toml"
+	envPrefix              = "MULTIDL_"
+)
+
+// Layers a setting can come from, lowest precedence first.
+const (
+	layerDefault = "default"
+	layerFile    = "file"
+	layerEnv     = "env"
+	layerFlag    = "flag"
+)
+
+type Config struct {
+	Jobs              int
+	Profile           string
+	AudioQuality      string
+	SplitChapters     bool
+	ChapterMode       string
+	ChapterSource     string
+	PlaylistFormat    string
+	EmbedThumbnail    bool
+	AudioJobs         int
+	LoudnessTarget    int
+	SilenceThreshold  int
+	FadeDuration      time.Duration
+	OutputDir         string
+	OutputTemplate    string
+	PlaylistTemplate  string
+	ChapterTemplate   string
+	WindowsFilenames  bool
+	MaxFilenameLength int
+	Retries           int
+	RetryDelay        time.Duration
+	Progress          string
+	LinePrefix        string
+	LogDir            string
+	Tag               bool
+	TagTitle          string
+	TagAlbum          string
+	TagArtist         string
+	TagTrack          string
+	TagDate           string
+	TagComment        string
+	Verify            bool
+	VerifyTolerance   time.Duration
+	DryRun            bool
+	Archive           string
+	NoArchive         bool
+	ArchiveReadonly   bool
+	FailOnSkip        bool
+	Report            string
+	Events            string
+	EventsFD          int
+	MinYtdlpVersion   string
+	MinFFmpegVersion  string
+
+	Profiles    map[string]*Profile
+	BatchFiles  []string
+	ConfigFile  string            // path of the config file that was looked for
+	ConfigFound bool              // whether ConfigFile existed
+	Sources     map[string]string // setting key -> layer that set it
+	Args        []string
+}
+
+// setting describes one configurable value. The same key is used in the
+// config file, as MULTIDL_<KEY> in the environment and as --<key> on the
+// command line (underscores become dashes).
+type setting struct {
+	Key   string
+	Short string
+	Usage string
+	field func(*Config) any
+}
+
+var settings = []setting{
+	{"jobs", "j", "number of concurrent downloads", func(c *Config) any { return &c.Jobs }},
+	{"profile", "", "download profile for items without a PROFILE: prefix", func(c *Config) any { return &c.Profile }},
+	{"audio_quality", "", "yt-dlp --audio-quality value (0 is best) for audio profiles", func(c *Config) any { return &c.AudioQuality }},
+	{"split_chapters", "", "allow profiles to split the audio into one file per chapter", func(c *Config) any { return &c.SplitChapters }},
+	{"chapter_mode", "", "what split-chapters profiles keep: split, whole, both or cue (whole file and a .cue sheet)", func(c *Config) any { return &c.ChapterMode }},
+	{"chapter_source", "", "chapters for videos without a chapter file: auto, metadata, description or none", func(c *Config) any { return &c.ChapterSource }},
+	{"playlist_format", "", "playlist file written next to chapter files and for each playlist: m3u8, pls, xspf or none", func(c *Config) any { return &c.PlaylistFormat }},
+	{"embed_thumbnail", "", "allow profiles to embed the video thumbnail as cover art", func(c *Config) any { return &c.EmbedThumbnail }},
+	{"audio_jobs", "", "number of files the normalize, replaygain, trim-silence and fade steps work on at once", func(c *Config) any { return &c.AudioJobs }},
+	{"loudness_target", "", "integrated loudness the normalize step aims for, in LUFS", func(c *Config) any { return &c.LoudnessTarget }},
+	{"silence_threshold", "", "level below which the trim-silence step counts audio as silence, in dB", func(c *Config) any { return &c.SilenceThreshold }},
+	{"fade_duration", "", "length of the fade step's fade-in and fade-out", func(c *Config) any { return &c.FadeDuration }},
+	{"output_dir", "o", "base directory for downloaded files", func(c *Config) any { return &c.OutputDir }},
+	{"output_template", "", "output template for single items, relative to output_dir", func(c *Config) any { return &c.OutputTemplate }},
+	{"playlist_template", "", "output template for items expanded from a playlist", func(c *Config) any { return &c.PlaylistTemplate }},
+	{"chapter_template", "", "output template for chapter files of split items", func(c *Config) any { return &c.ChapterTemplate }},
+	{"windows_filenames", "", "keep file names FAT/NTFS-safe (yt-dlp --windows-filenames)", func(c *Config) any { return &c.WindowsFilenames }},
+	{"max_filename_length", "", "cap file names at this many characters (0 for no cap)", func(c *Config) any { return &c.MaxFilenameLength }},
+	{"retries", "", "retries per item for transient failures (network, HTTP 429, ...)", func(c *Config) any { return &c.Retries }},
+	{"retry_delay", "", "base delay before the first retry, doubled on each retry", func(c *Config) any { return &c.RetryDelay }},
+	{"progress", "", "progress display: auto (dashboard on a terminal), dashboard or plain", func(c *Config) any { return &c.Progress }},
+	{"line_prefix", "", "prefix for yt-dlp output lines: number (item number) or id (short id)", func(c *Config) any { return &c.LinePrefix }},
+	{"verify", "", "check each output file with ffprobe (non-empty, codec, duration) before archiving", func(c *Config) any { return &c.Verify }},
+	{"verify_tolerance", "", "how far a file's duration may differ from the metadata (at least 1%)", func(c *Config) any { return &c.VerifyTolerance }},
+	{"tag", "", "write title, album, artist, track, date and source URL tags into each output file", func(c *Config) any { return &c.Tag }},
+	{"tag_title", "", "title tag template", func(c *Config) any { return &c.TagTitle }},
+	{"tag_album", "", "album tag template", func(c *Config) any { return &c.TagAlbum }},
+	{"tag_artist", "", "artist tag template", func(c *Config) any { return &c.TagArtist }},
+	{"tag_track", "", "track tag template", func(c *Config) any { return &c.TagTrack }},
+	{"tag_date", "", "date tag template", func(c *Config) any { return &c.TagDate }},
+	{"tag_comment", "", "comment tag template", func(c *Config) any { return &c.TagComment }},
+	{"dry_run", "n", "print what would be downloaded, with the yt-dlp commands, and exit", func(c *Config) any { return &c.DryRun }},
+	{"archive", "", "archive file (default in the user data directory)", func(c *Config) any { return &c.Archive }},
+	{"no_archive", "", "neither skip archived items nor record new ones", func(c *Config) any { return &c.NoArchive }},
+	{"archive_readonly", "", "skip archived items but don't record new ones", func(c *Config) any { return &c.ArchiveReadonly }},
+	{"fail_on_skip", "", "count skipped items as failures in the exit code", func(c *Config) any { return &c.FailOnSkip }},
+	{"report", "", "write a JSON report of every item to this file when the run ends", func(c *Config) any { return &c.Report }},
+	{"events", "", "stream lifecycle events in this format (ndjson)", func(c *Config) any { return &c.Events }},
+	{"events_fd", "", "file descriptor for --events; with 1 (stdout) other output goes to stderr", func(c *Config) any { return &c.EventsFD }},
+	{"min_ytdlp_version", "", "oldest yt-dlp version accepted at startup", func(c *Config) any { return &c.MinYtdlpVersion }},
+	{"min_ffmpeg_version", "", "oldest ffmpeg/ffprobe version accepted at startup", func(c *Config) any { return &c.MinFFmpegVersion }},
+	{"log_dir", "", "directory for per-run logs of every item's yt-dlp output (empty disables)", func(c *Config) any { return &c.LogDir }},
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Jobs:              defaultJobs(),
+		Profile:           defaultProfile,
+		AudioQuality:      defaultAudioQuality,
+		SplitChapters:     true,
+		ChapterMode:       chapterSplit,
+		ChapterSource:     sourceAuto,
+		PlaylistFormat:    formatM3U8,
+		EmbedThumbnail:    true,
+		AudioJobs:         defaultAudioJobs(),
+		LoudnessTarget:    defaultLoudnessTarget,
+		SilenceThreshold:  defaultSilenceThreshold,
+		FadeDuration:      defaultFadeDuration,
+		OutputDir:         defaultOutputDir,
+		OutputTemplate:    defaultOutputTemplate,
+		PlaylistTemplate:  defaultPlaylistTemplate,
+		ChapterTemplate:   defaultChapterTemplate,
+		WindowsFilenames:  true,
+		MaxFilenameLength: defaultMaxFilenameLength,
+		Retries:           defaultRetries,
+		RetryDelay:        defaultRetryDelay,
+		Progress:          progressAuto,
+		LinePrefix:        prefixNumber,
+		LogDir:            defaultLogDir,
+		Verify:            true,
+		VerifyTolerance:   defaultVerifyTolerance,
+		Tag:               true,
+		TagTitle:          "{section_title}",
+		TagAlbum:          "{title}",
+		TagArtist:         "{uploader}",
+		TagTrack:          "{track}/{tracks}",
+		TagDate:           "{year}",
+		TagComment:        "{url}",
+		EventsFD:          1,
+		MinYtdlpVersion:   defaultMinYtdlpVersion,
+		MinFFmpegVersion:  defaultMinFFmpegVersion,
+		Profiles:          builtinProfiles(),
+		Sources:           make(map[string]string),
+	}
+}
+
+func (s setting) flagName() string {
+	return strings.ReplaceAll(s.Key, "_", "-")
+}
+
+func (s setting) envName() string {
+	return envPrefix + strings.ToUpper(s.Key)
+}
+
+func (s setting) isBool() bool {
+	_, ok := s.field(&Config{}).(*bool)
+	return ok
+}
+
+func (s setting) set(cfg *Config, raw, layer string) error {
+	switch p := s.field(cfg).(type) {
+	case *string:
+		*p = raw
+	case *int:
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%s: expected an integer, got %q", s.Key, raw)
+		}
+		*p = n
+	case *bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%s: expected true or false, got %q", s.Key, raw)
+		}
+		*p = b
+	case *time.Duration:
+		d, err := time.ParseDuration(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%s: expected a duration such as 5s or 1m, got %q", s.Key, raw)
+		}
+		*p = d
+	}
+	cfg.Sources[s.Key] = layer
+	return nil
+}
+
+func (s setting) get(cfg *Config) string {
+	switch p := s.field(cfg).(type) {
+	case *string:
+		return *p
+	case *int:
+		return strconv.Itoa(*p)
+	case *bool:
+		return strconv.FormatBool(*p)
+	case *time.Duration:
+		return p.String()
+	}
+	return ""
+}
+
+// rawFlag records the command-line value of a setting so that flags can be
+// applied last, after the config file and environment.
+type rawFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *rawFlag) String() string     { return f.value }
+func (f *rawFlag) Set(v string) error { f.value = v; return nil }
+func (f *rawFlag) IsBoolFlag() bool   { return f.isBool }
+
+// loadConfig builds the effective configuration from defaults, the config
+// file, MULTIDL_* environment variables and finally the command line.
+func loadConfig(args []string) (*Config, error) {
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Usage = func() {}
+
+	var configPath string
+	var batchFiles stringList
+	fs.StringVar(&configPath, "config", "", "config file path")
+	fs.Var(&batchFiles, "a", "batch file")
+	fs.Var(&batchFiles, "batch-file", "batch file")
+
+	raw := make(map[string]*rawFlag, len(settings))
+	for _, s := range settings {
+		rf := &rawFlag{isBool: s.isBool()}
+		raw[s.Key] = rf
+		fs.Var(rf, s.flagName(), s.Usage)
+		if s.Short != "" {
+			fs.Var(rf, s.Short, s.Usage)
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := defaultConfig()
+	for _, s := range settings {
+		cfg.Sources[s.Key] = layerDefault
+	}
+
+	explicit := configPath != ""
+	if !explicit {
+		configPath = os.Getenv(envPrefix + "CONFIG")
+		explicit = configPath != ""
+	}
+	if !explicit {
+		configPath = defaultConfigPath()
+	}
+	cfg.ConfigFile = configPath
+
+	if configPath != "" {
+		values, err := readConfigFile(configPath)
+		switch {
+		case err == nil:
+			cfg.ConfigFound = true
+			if err := applyConfigFile(cfg, values); err != nil {
+				return nil, fmt.Errorf("%s: %w", configPath, err)
+			}
+		case errors.Is(err, os.ErrNotExist) && !explicit:
+		default:
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.envName()); ok {
+			if err := s.set(cfg, v, layerEnv); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.envName(), err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		rf, ok := f.Value.(*rawFlag)
+		if !ok || flagErr != nil {
+			return
+		}
+		for _, s := range settings {
+			if raw[s.Key] == rf {
+				flagErr = s.set(cfg, rf.value, layerFlag)
+				return
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if _, ok := cfg.Profiles[cfg.Profile]; !ok {
+		return nil, fmt.Errorf("unknown profile %q (known: %s)", cfg.Profile, strings.Join(slices.Sorted(maps.Keys(cfg.Profiles)), ", "))
+	}
+	if err := checkTemplates(cfg); err != nil {
+		return nil, err
+	}
+	if err := checkChapterSettings(cfg); err != nil {
+		return nil, err
+	}
+	if err := checkPlaylistFormat(cfg); err != nil {
+		return nil, err
+	}
+	if err := checkAudioSettings(cfg); err != nil {
+		return nil, err
+	}
+
+	cfg.BatchFiles = batchFiles
+	cfg.Args = fs.Args()
+	return cfg, nil
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, configDirName, configFilename)
+}
+
+func applyConfigFile(cfg *Config, values map[string]configValue) error {
+	known := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		known[s.Key] = s
+	}
+
+	if err := applyProfileValues(cfg.Profiles, values); err != nil {
+		return err
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		if strings.HasPrefix(key, "profile.") {
+			continue
+		}
+		v := values[key]
+		s, ok := known[key]
+		if !ok {
+			log.Printf("WARN: %s: line %d: unknown setting %q", cfg.ConfigFile, v.Line, key)
+			continue
+		}
+		if v.IsList {
+			return fmt.Errorf("line %d: %s does not take a list", v.Line, key)
+		}
+		if err := s.set(cfg, v.Str, layerFile); err != nil {
+			return fmt.Errorf("line %d: %w", v.Line, err)
+		}
+	}
+	return nil
+}
+
+// configValue is a single value from the config file: either a scalar kept
+// as its string form or a list of strings.
+type configValue struct {
+	Str    string
+	List   []string
+	IsList bool
+	Line   int
+}
+
+func readConfigFile(path string) (map[string]configValue, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values, err := parseConfig(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+// parseConfig reads the subset of TOML we need: [section] headers,
+// key = value pairs with strings, numbers and booleans, arrays of strings
+// (which may span lines) and # comments. Keys inside a section are returned
+// as "section.key".
+func parseConfig(r io.Reader) (map[string]configValue, error) {
+	values := make(map[string]configValue)
+	scanner := bufio.NewScanner(r)
+	section := ""
+	lineNo := 0
+
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: malformed section header", lineNo)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		key, rawValue, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		key = strings.TrimSpace(key)
+		rawValue = strings.TrimSpace(rawValue)
+		if section != "" {
+			key = section + "." + key
+		}
+		startLine := lineNo
+
+		if strings.HasPrefix(rawValue, "[") {
+			for !strings.HasSuffix(rawValue, "]") && scanner.Scan() {
+				lineNo++
+				rawValue += " " + strings.TrimSpace(stripComment(scanner.Text()))
+			}
+			if !strings.HasSuffix(rawValue, "]") {
+				return nil, fmt.Errorf("line %d: unterminated list", startLine)
+			}
+			list, err := parseList(rawValue)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", startLine, err)
+			}
+			values[key] = configValue{List: list, IsList: true, Line: startLine}
+			continue
+		}
+
+		str, err := parseScalar(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", startLine, err)
+		}
+		values[key] = configValue{Str: str, Line: startLine}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// stripComment removes a trailing # comment that is not inside quotes.
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseScalar(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		s, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", fmt.Errorf("bad string %s", raw)
+		}
+		return s, nil
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return "", fmt.Errorf("bad string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	}
+	return raw, nil
+}
+
+func parseList(raw string) ([]string, error) {
+	if len(raw) < 2 || raw[0] != '[' || raw[len(raw)-1] != ']' {
+		return nil, fmt.Errorf("unterminated list")
+	}
+	inner := strings.TrimSpace(raw[1 : len(raw)-1])
+	var list []string
+	for inner != "" {
+		var item string
+		switch inner[0] {
+		case '"', '\'':
+			end := strings.IndexByte(inner[1:], inner[0])
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string in list")
+			}
+			s, err := parseScalar(inner[:end+2])
+			if err != nil {
+				return nil, err
+			}
+			item, inner = s, inner[end+2:]
+		default:
+			next := strings.IndexByte(inner, ',')
+			if next < 0 {
+				next = len(inner)
+			}
+			item, inner = strings.TrimSpace(inner[:next]), inner[next:]
+		}
+		list = append(list, item)
+
+		inner = strings.TrimSpace(inner)
+		if strings.HasPrefix(inner, ",") {
+			inner = strings.TrimSpace(inner[1:])
+		} else if inner != "" {
+			return nil, fmt.Errorf("expected , between list items")
+		}
+	}
+	return list, nil
+}
+
+func runConfigCommand(args []string) int {
+	if len(args) == 0 || args[0] != "show" {
+		fmt.Fprintf(os.Stderr, "Usage: %s config show [OPTIONS]\n", filepath.Base(os.Args[0]))
+		return exitUsage
+	}
+
+	cfg, err := loadConfig(args[1:])
+	if err != nil {
+		log.Printf("FATAL: %v", err)
+		return exitUsage
+	}
+
+	switch {
+	case cfg.ConfigFile == "":
+		fmt.Println("Config file: (no config directory)")
+	case cfg.ConfigFound:
+		fmt.Printf("Config file: %s\n", cfg.ConfigFile)
+	default:
+		fmt.Printf("Config file: %s (not found)\n", cfg.ConfigFile)
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SETTING\tVALUE\tSOURCE")
+	for _, s := range settings {
+		source := cfg.Sources[s.Key]
+		switch source {
+		case layerEnv:
+			source = "env " + s.envName()
+		case layerFlag:
+			source = "flag --" + s.flagName()
+		}
+		fmt.Fprintf(w, "%s\t%q\t%s\n", s.Key, s.get(cfg), source)
+	}
+	w.Flush()
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROFILE\tDESCRIPTION\tSOURCE")
+	for _, name := range slices.Sorted(maps.Keys(cfg.Profiles)) {
+		p := cfg.Profiles[name]
+		source := "builtin"
+		if !p.Builtin {
+			source = "file"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", name, p.Description, source)
+	}
+	w.Flush()
+	return exitOK
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	input := `
+# comment
+jobs = 2
+audio_quality = "5"   # trailing comment
+output_dir = 'single # quoted'
+verify = false
+retry_delay = 10s
+args = ["--a", 'b', c]
+multi = [
+  "x",   # first
+  "y",
+]
+empty = []
+
+[profile.podcast]
+format = "ba/b"
+`
+	values, err := parseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scalars := map[string]string{
+		"jobs":                   "2",
+		"audio_quality":          "5",
+		"output_dir":             "single # quoted",
+		"verify":                 "false",
+		"retry_delay":            "10s",
+		"profile.podcast.format": "ba/b",
+	}
+	for key, want := range scalars {
+		v, ok := values[key]
+		if !ok || v.IsList || v.Str != want {
+			t.Errorf("%s = %+v, want %q", key, v, want)
+		}
+	}
+
+	lists := map[string][]string{
+		"args":  {"--a", "b", "c"},
+		"multi": {"x", "y"},
+		"empty": nil,
+	}
+	for key, want := range lists {
+		v, ok := values[key]
+		if !ok || !v.IsList || !slices.Equal(v.List, want) {
+			t.Errorf("%s = %+v, want list %q", key, v, want)
+		}
+	}
+
+	if got := values["multi"].Line; got != 9 {
+		t.Errorf("multi line = %d, want 9", got)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name, input, want string
+	}{
+		{"no equals", "jobs 2", "line 1: expected key = value"},
+		{"bad header", "[profile.x", "line 1: malformed section header"},
+		{"bad string", `a = "unterminated`, "line 1: bad string"},
+		{"bad list", `a = ["x" "y"]`, "line 1: expected , between list items"},
+		{"unterminated list item", `a = ["x]`, "line 1: unterminated string in list"},
+		{"list at end of file", "jobs = 1\nargs = [", "line 2: unterminated list"},
+		{"list without bracket", "args = [\"a\",\n\"b\",", "line 1: unterminated list"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig(strings.NewReader(tt.input))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripComment(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"a = 1 # c", "a = 1 "},
+		{`a = "x # y" # c`, `a = "x # y" `},
+		{`a = 'it''s' # c`, `a = 'it''s' `},
+		{"# whole line", ""},
+		{"a = 1", "a = 1"},
+	}
+	for _, tt := range tests {
+		if got := stripComment(tt.in); got != tt.want {
+			t.Errorf("stripComment(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestLoadConfigLayers checks that each layer overrides the one below it:
+// defaults, then the config file, then the environment, then flags.
+func TestLoadConfigLayers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	config := `
+jobs = 2
+retries = 5
+audio_quality = "3"
+
+[profile.mine]
+extends = "audio-mp3"
+audio_quality = "7"
+loudness_target = -14
+`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envPrefix+"CONFIG", path)
+	t.Setenv(envPrefix+"RETRIES", "6")
+	t.Setenv(envPrefix+"AUDIO_QUALITY", "4")
+
+	cfg, err := loadConfig([]string{"--audio-quality", "1", "--retry-delay=30s", "URL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key, value, layer string
+	}{
+		{"jobs", "2", layerFile},
+		{"retries", "6", layerEnv},
+		{"audio_quality", "1", layerFlag},
+		{"retry_delay", (30 * time.Second).String(), layerFlag},
+		{"verify", "true", layerDefault},
+	}
+	for _, tt := range tests {
+		for _, s := range settings {
+			if s.Key != tt.key {
+				continue
+			}
+			if got := s.get(cfg); got != tt.value {
+				t.Errorf("%s = %q, want %q", tt.key, got, tt.value)
+			}
+			if got := cfg.Sources[tt.key]; got != tt.layer {
+				t.Errorf("%s source = %q, want %q", tt.key, got, tt.layer)
+			}
+		}
+	}
+
+	p := cfg.Profiles["mine"]
+	if p == nil || p.AudioQuality != "7" || p.AudioFormat != "mp3" || p.Builtin {
+		t.Errorf("profile mine = %+v, want audio-mp3 with audio_quality 7", p)
+	}
+	if p != nil && (p.LoudnessTarget == nil || *p.LoudnessTarget != -14 || p.FadeDuration != nil) {
+		t.Errorf("profile mine audio overrides = %v, %v, want -14 and none", p.LoudnessTarget, p.FadeDuration)
+	}
+	if !slices.Equal(cfg.Args, []string{"URL"}) {
+		t.Errorf("args = %q, want [URL]", cfg.Args)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name, config, want string
+	}{
+		{"bad int", "jobs = many", `jobs: expected an integer, got "many"`},
+		{"list for scalar", `jobs = ["1"]`, "jobs does not take a list"},
+		{"extends loop", "[profile.a]\nextends = \"b\"\n[profile.b]\nextends = \"a\"", "extends loop"},
+		{"unknown step", "[profile.a]\npostprocess = [\"dance\"]", `unknown post-processing step "dance"`},
+		{"bad profile duration", "[profile.a]\nfade_duration = \"long\"", `fade_duration: expected a duration such as 5s or 1m, got "long"`},
+		{"negative profile fade", "[profile.a]\nfade_duration = \"-1s\"", `profile "a": fade_duration must not be negative`},
+		{"unknown template field", `output_template = "{nope}.%(ext)s"`, "unknown field {nope}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.toml")
+			if err := os.WriteFile(path, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadConfig([]string{"--config", path})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
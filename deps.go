@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	defaultMinYtdlpVersion  = "2023.03.04"
+	defaultMinFFmpegVersion = "4.0"
+	versionTimeout          = 15 * time.Second
+)
+
+var versionNumber = regexp.MustCompile(`\d+(?:\.\d+)+`)
+
+// dependency is an external program we run. Its version is the first
+// dotted number on the first line of VersionArgs' output: yt-dlp prints a
+// bare date version, ffmpeg a banner.
+type dependency struct {
+	Name        string
+	VersionArgs []string
+	minVersion  func(*Config) string
+}
+
+var dependencies = []dependency{
+	{"yt-dlp", []string{"--version"}, func(c *Config) string { return c.MinYtdlpVersion }},
+	{"ffmpeg", []string{"-version"}, func(c *Config) string { return c.MinFFmpegVersion }},
+	{"ffprobe", []string{"-version"}, func(c *Config) string { return c.MinFFmpegVersion }},
+}
+
+// dependencyStatus is what was found for one dependency.
+type dependencyStatus struct {
+	dependency
+	Path    string
+	Version string // empty if it couldn't be determined
+	Err     error
+}
+
+func (s dependencyStatus) describe() string {
+	if s.Err != nil {
+		return s.Err.Error()
+	}
+	return "ok"
+}
+
+// checkDependency looks dep up in PATH and checks its version against the
+// configured minimum. Versions we can't parse, like ffmpeg git builds, are
+// accepted.
+func checkDependency(ctx context.Context, cfg *Config, dep dependency) dependencyStatus {
+	status := dependencyStatus{dependency: dep}
+	path, err := exec.LookPath(dep.Name)
+	if err != nil {
+		status.Err = fmt.Errorf("not found in PATH")
+		return status
+	}
+	status.Path = path
+
+	ctx, cancel := context.WithTimeout(ctx, versionTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, dep.VersionArgs...).Output()
+	if err != nil {
+		status.Err = fmt.Errorf("%s failed: %w", strings.Join(append([]string{dep.Name}, dep.VersionArgs...), " "), err)
+		return status
+	}
+	status.Version = versionNumber.FindString(firstLine(string(out)))
+
+	if min := dep.minVersion(cfg); min != "" && status.Version != "" && compareVersions(status.Version, min) < 0 {
+		status.Err = fmt.Errorf("version %s is older than the required %s", status.Version, min)
+	}
+	return status
+}
+
+// checkDependencies is the startup preflight: every dependency must exist
+// and be recent enough, so a missing tool fails once instead of per item.
+func checkDependencies(cfg *Config) error {
+	var problems []string
+	for _, dep := range dependencies {
+		if status := checkDependency(context.Background(), cfg, dep); status.Err != nil {
+			problems = append(problems, dep.Name+": "+status.Err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("dependency check failed (run \"%s doctor\" for details):\n  %s",
+			filepath.Base(os.Args[0]), strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return line
+}
+
+// compareVersions compares dotted numeric versions like 2024.08.06 or
+// 6.1.1, treating missing components as zero.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < max(len(as), len(bs)); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// runDoctor implements "doctor": it reports everything a run depends on and
+// returns non-zero if anything would stop one.
+func runDoctor(args []string) int {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			log.Printf("FATAL: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Usage: %s doctor [OPTIONS]\n", filepath.Base(os.Args[0]))
+		return exitUsage
+	}
+
+	code := exitOK
+	fail := func(c int) {
+		if code == exitOK {
+			code = c
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEPENDENCY\tPATH\tVERSION\tMINIMUM\tSTATUS")
+	for _, dep := range dependencies {
+		status := checkDependency(context.Background(), cfg, dep)
+		if status.Err != nil {
+			fail(exitDependency)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", dep.Name, orDash(status.Path), orDash(status.Version),
+			orDash(dep.minVersion(cfg)), status.describe())
+	}
+	w.Flush()
+	fmt.Println()
+
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	switch {
+	case cfg.ConfigFile == "":
+		fmt.Fprintln(w, "Config file:\t(no config directory)")
+	case cfg.ConfigFound:
+		fmt.Fprintf(w, "Config file:\t%s\n", cfg.ConfigFile)
+	default:
+		fmt.Fprintf(w, "Config file:\t%s (not found, using defaults)\n", cfg.ConfigFile)
+	}
+
+	outputDir, _ := filepath.Abs(cfg.OutputDir)
+	if err := checkWritableDir(outputDir); err != nil {
+		fail(exitUsage)
+		fmt.Fprintf(w, "Output directory:\t%s (%v)\n", outputDir, err)
+	} else {
+		fmt.Fprintf(w, "Output directory:\t%s (writable)\n", outputDir)
+	}
+	if free, err := freeDiskSpace(outputDir); err != nil {
+		fmt.Fprintf(w, "Free disk space:\tunknown (%v)\n", err)
+	} else {
+		fmt.Fprintf(w, "Free disk space:\t%s\n", formatBytes(int64(free)))
+	}
+
+	if archivePath, err := resolveArchivePath(cfg); cfg.NoArchive {
+		fmt.Fprintln(w, "Archive:\tdisabled (--no-archive)")
+	} else if err != nil {
+		fail(exitUsage)
+		fmt.Fprintf(w, "Archive:\t%v\n", err)
+	} else if cfg.ArchiveReadonly {
+		fmt.Fprintf(w, "Archive:\t%s (read-only)\n", archivePath)
+	} else if err := checkWritableFile(archivePath); err != nil {
+		fail(exitUsage)
+		fmt.Fprintf(w, "Archive:\t%s (%v)\n", archivePath, err)
+	} else {
+		fmt.Fprintf(w, "Archive:\t%s (writable)\n", archivePath)
+	}
+	w.Flush()
+
+	return code
+}
+
+// checkWritableDir creates and removes a temporary file in dir. A missing
+// dir is fine as long as its nearest existing parent is writable.
+func checkWritableDir(dir string) error {
+	dir = existingParent(dir)
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("not a directory")
+	}
+
+	file, err := os.CreateTemp(dir, ".multidl-doctor-*")
+	if err != nil {
+		return fmt.Errorf("not writable: %w", err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// existingParent returns path, or its nearest ancestor that exists.
+func existingParent(path string) string {
+	for {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// checkWritableFile opens path for appending without creating it, or checks
+// its directory if it doesn't exist yet.
+func checkWritableFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return checkWritableDir(filepath.Dir(path))
+	}
+	if err != nil {
+		return fmt.Errorf("not writable: %w", err)
+	}
+	return file.Close()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package main
+
+import "syscall"
+
+// freeDiskSpace returns the bytes available to us on the filesystem holding
+// path, or its nearest existing parent.
+func freeDiskSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(existingParent(path), &st)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
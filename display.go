@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	progressAuto      = "auto"
+	progressDashboard = "dashboard"
+	progressPlain     = "plain"
+
+	prefixNumber = "number"
+	prefixID     = "id"
+
+	dashboardRefresh = 150 * time.Millisecond
+	progressBarWidth = 24
+)
+
+// progressTemplate is passed to yt-dlp so progressLine can parse its output.
+const progressTemplate = "[download] %(progress._percent_str)s of %(progress._total_bytes_str)s at %(progress._speed_str)s ETA %(progress._eta_str)s"
+
+var (
+	progressLine = regexp.MustCompile(`^\[download\]\s+([\d.]+)%\s+of\s+~?\s*(.+?)\s+at\s+(.+?)\s+ETA\s+(\S+)`)
+	speedValue   = regexp.MustCompile(`^([\d.]+)\s*([KMGT]i?)?B/s$`)
+	phaseLine    = regexp.MustCompile(`^\[(ExtractAudio|SplitChapters|EmbedThumbnail|Metadata|Merger|VideoConvertor|FixupM3u8|MoveFiles|ThumbnailsConvertor|EmbedSubtitle)\]`)
+	ansiEscape   = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+)
+
+// display shows what the running items are doing: a redrawing dashboard on
+// a terminal, prefixed plain lines otherwise.
+type display interface {
+	// begin registers a starting item and returns the view its yt-dlp
+	// output is written to.
+	begin(item workItem) *itemView
+	// end removes a finished item.
+	end(view *itemView)
+	// logWriter is where application log output goes while the display
+	// is up.
+	logWriter() io.Writer
+	// stop tears the display down before the summary is printed.
+	stop()
+}
+
+var disp display = &plainDisplay{prefix: prefixNumber}
+
+func newDisplay(cfg *Config) (display, error) {
+	if cfg.LinePrefix != prefixNumber && cfg.LinePrefix != prefixID {
+		return nil, fmt.Errorf("line_prefix: expected number or id, got %q", cfg.LinePrefix)
+	}
+
+	switch cfg.Progress {
+	case progressAuto:
+		if isTerminal(os.Stdout) {
+			return newDashboard(cfg.LinePrefix), nil
+		}
+		return &plainDisplay{prefix: cfg.LinePrefix}, nil
+	case progressDashboard:
+		return newDashboard(cfg.LinePrefix), nil
+	case progressPlain:
+		return &plainDisplay{prefix: cfg.LinePrefix}, nil
+	}
+	return nil, fmt.Errorf("progress: expected auto, dashboard or plain, got %q", cfg.Progress)
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// itemView is the display state of one running item.
+type itemView struct {
+	item   workItem
+	label  string
+	prefix string // "[3]" or "[dQw4w9WgXcQ]", put before each output line
+	start  time.Time
+
+	// Guarded by outputMutex.
+	percent     float64
+	size, speed string
+	eta         string
+	bytesPerSec float64
+	phase       string
+	lastPlain   int // last progress decile printed in plain mode
+	lastEvent   int // last whole percent sent as a progress event
+
+	Stdout, Stderr *lineWriter
+}
+
+func newItemView(item workItem, prefixMode string, onLine func(v *itemView, line string, stderr bool)) *itemView {
+	v := &itemView{item: item, label: item.Title, start: time.Now(), lastPlain: -1, lastEvent: -1}
+	if v.label == "" {
+		v.label = item.Identifier
+	}
+	if prefixMode == prefixID {
+		v.prefix = "[" + shortID(item.Key) + "]"
+	} else {
+		v.prefix = fmt.Sprintf("[%d]", item.ItemNumber)
+	}
+	v.Stdout = &lineWriter{emit: func(line string) { onLine(v, line, false) }}
+	v.Stderr = &lineWriter{emit: func(line string) { onLine(v, line, true) }}
+	return v
+}
+
+// update parses one line of yt-dlp output into the view. It reports
+// whether the line was a progress line. Callers hold outputMutex.
+func (v *itemView) update(line string) bool {
+	if m := progressLine.FindStringSubmatch(line); m != nil {
+		v.percent, _ = strconv.ParseFloat(m[1], 64)
+		v.size, v.speed, v.eta = m[2], m[3], m[4]
+		v.bytesPerSec = parseSpeed(v.speed)
+		v.phase = ""
+		if whole := int(v.percent); whole != v.lastEvent {
+			v.lastEvent = whole
+			events.progress(v)
+		}
+		return true
+	}
+
+	if dest, ok := strings.CutPrefix(line, "[download] Destination: "); ok && v.item.Title == "" {
+		base := dest[strings.LastIndexAny(dest, `/\`)+1:]
+		if i := strings.LastIndexByte(base, '.'); i > 0 {
+			base = base[:i]
+		}
+		v.label = base
+	}
+	if m := phaseLine.FindStringSubmatch(line); m != nil {
+		v.phase = m[1]
+		v.bytesPerSec = 0
+	}
+	return false
+}
+
+func parseSpeed(s string) float64 {
+	m := speedValue.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.ParseFloat(m[1], 64)
+	switch strings.TrimSuffix(m[2], "i") {
+	case "K":
+		n *= 1 << 10
+	case "M":
+		n *= 1 << 20
+	case "G":
+		n *= 1 << 30
+	case "T":
+		n *= 1 << 40
+	}
+	return n
+}
+
+// lineWriter splits a child's output into lines, treating \r as a line
+// end too, and hands each one without escape codes to emit.
+type lineWriter struct {
+	mu   sync.Mutex
+	buf  []byte
+	emit func(line string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexAny(w.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		line := string(w.buf[:i])
+		w.buf = w.buf[i+1:]
+		if line = strings.TrimRight(ansiEscape.ReplaceAllString(line, ""), " "); line != "" {
+			w.emit(line)
+		}
+	}
+	return len(p), nil
+}
+
+// Flush emits a trailing line that had no newline.
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if line := strings.TrimSpace(ansiEscape.ReplaceAllString(string(w.buf), "")); line != "" {
+		w.emit(line)
+	}
+	w.buf = nil
+}
+
+// plainDisplay prints each item's banner and then its output on stdout,
+// one whole line at a time, prefixed with the item number or short id.
+// Progress is reduced to every 10%.
+type plainDisplay struct {
+	prefix string
+}
+
+func (d *plainDisplay) begin(item workItem) *itemView {
+	v := newItemView(item, d.prefix, d.line)
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	fmt.Printf("\n╔════ ITEM %s ════════════════════════════════\n", itemCount(uint64(item.ItemNumber)))
+	fmt.Printf("║ URL: %s\n", item.Identifier)
+	if item.Playlist != nil {
+		fmt.Printf("║ Playlist: %s (%d/%d)\n", item.Playlist.Title, item.PlaylistIndex, item.Playlist.Count)
+	}
+	if item.Title != "" {
+		fmt.Printf("║ Title: %s\n", item.Title)
+	}
+	fmt.Printf("║ Profile: %s\n", item.Profile.Name)
+	if item.Subdir != "" {
+		fmt.Printf("║ Subdir: %s\n", item.Subdir)
+	}
+	fmt.Printf("║ Start: %s\n", v.start.Format("15:04:05"))
+	fmt.Println("╚═══════════════════════════════════════════════")
+	return v
+}
+
+func (d *plainDisplay) line(v *itemView, line string, stderr bool) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	if v.update(line) {
+		decile := int(v.percent / 10)
+		if decile == v.lastPlain {
+			return
+		}
+		v.lastPlain = decile
+	}
+
+	fmt.Fprintf(os.Stdout, "%s %s\n", v.prefix, line)
+}
+
+func (d *plainDisplay) end(v *itemView) {
+	v.Stdout.Flush()
+	v.Stderr.Flush()
+}
+
+func (d *plainDisplay) logWriter() io.Writer { return os.Stderr }
+
+func (d *plainDisplay) stop() {}
+
+// dashboard redraws one row per running item plus a totals row at the
+// bottom of the terminal. Log output and yt-dlp errors and warnings are
+// printed above it.
+type dashboard struct {
+	prefix string
+	views  []*itemView // guarded by outputMutex
+	drawn  int         // rows currently on screen
+	dirty  bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newDashboard(prefix string) *dashboard {
+	d := &dashboard{prefix: prefix, done: make(chan struct{})}
+	d.wg.Add(1)
+	go d.refresh()
+	return d
+}
+
+func (d *dashboard) refresh() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(dashboardRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			outputMutex.Lock()
+			if d.dirty {
+				d.clearLocked()
+				d.drawLocked()
+			}
+			outputMutex.Unlock()
+		case <-d.done:
+			return
+		}
+	}
+}
+
+func (d *dashboard) logWriter() io.Writer { return d }
+
+// Write prints log output above the dashboard.
+func (d *dashboard) Write(p []byte) (int, error) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	d.clearLocked()
+	n, err := os.Stderr.Write(p)
+	d.drawLocked()
+	return n, err
+}
+
+func (d *dashboard) begin(item workItem) *itemView {
+	v := newItemView(item, d.prefix, d.line)
+	outputMutex.Lock()
+	d.views = append(d.views, v)
+	d.dirty = true
+	outputMutex.Unlock()
+	return v
+}
+
+func (d *dashboard) line(v *itemView, line string, stderr bool) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	v.update(line)
+	d.dirty = true
+
+	if strings.HasPrefix(line, "ERROR:") || strings.HasPrefix(line, "WARNING:") {
+		d.clearLocked()
+		fmt.Fprintf(os.Stderr, "%s %s\n", v.prefix, line)
+		d.drawLocked()
+	}
+}
+
+func (d *dashboard) end(v *itemView) {
+	v.Stdout.Flush()
+	v.Stderr.Flush()
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	for i, other := range d.views {
+		if other == v {
+			d.views = append(d.views[:i], d.views[i+1:]...)
+			break
+		}
+	}
+	d.dirty = true
+}
+
+func (d *dashboard) stop() {
+	close(d.done)
+	d.wg.Wait()
+
+	outputMutex.Lock()
+	d.clearLocked()
+	outputMutex.Unlock()
+}
+
+func (d *dashboard) clearLocked() {
+	if d.drawn > 0 {
+		fmt.Fprintf(os.Stdout, "\x1b[%dA\x1b[J", d.drawn)
+		d.drawn = 0
+	}
+}
+
+func (d *dashboard) drawLocked() {
+	width := terminalWidth() - 1
+	var sb strings.Builder
+	var totalSpeed float64
+
+	for _, v := range d.views {
+		totalSpeed += v.bytesPerSec
+		sb.WriteString(fitWidth(d.row(v), width))
+		sb.WriteByte('\n')
+	}
+
+	done := processedCount.Load() + skippedCount.Load() + errorCount.Load() + notStartedCount.Load() + killedCount.Load()
+	totals := fmt.Sprintf("── %d running · %s done · %s/s · %s elapsed",
+		len(d.views), itemCount(done), formatBytes(int64(totalSpeed)), time.Since(startTime).Round(time.Second))
+	sb.WriteString(fitWidth(totals, width))
+	sb.WriteByte('\n')
+
+	os.Stdout.WriteString(sb.String())
+	d.drawn = len(d.views) + 1
+	d.dirty = false
+}
+
+func (d *dashboard) row(v *itemView) string {
+	prefix := v.prefix + " " + fitWidth(v.label, 24) + " "
+	switch {
+	case v.phase != "":
+		return prefix + v.phase + "…"
+	case v.size == "":
+		return prefix + "starting…"
+	}
+
+	filled := int(v.percent / 100 * progressBarWidth)
+	filled = min(max(filled, 0), progressBarWidth)
+	bar := strings.Repeat("█", filled) + strings.Repeat("░", progressBarWidth-filled)
+	return fmt.Sprintf("%s%s %5.1f%% of %s at %s ETA %s", prefix, bar, v.percent, v.size, v.speed, v.eta)
+}
+
+// fitWidth pads or truncates s to exactly width runes.
+func fitWidth(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) > width {
+		if width <= 1 {
+			return string(runes[:width])
+		}
+		return string(runes[:width-1]) + "…"
+	}
+	return s + strings.Repeat(" ", width-len(runes))
+}
+
+func columnsFromEnv() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	return 100
+}
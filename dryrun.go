@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// plannedItem is one row of the --dry-run plan.
+type plannedItem struct {
+	workItem
+	Action string // "download" or "skip"
+	Reason string // why an item is skipped, or the error that stops it
+	Argv   []string
+	Output string // the path yt-dlp would write, or the template if unknown
+}
+
+const resolveTimeout = 2 * time.Minute
+
+// runDryRun resolves, canonicalizes and expands every input like a real run
+// would, then prints what would happen to each item without downloading or
+// writing anything.
+func runDryRun(ctx context.Context, cfg *Config, items []workItem, useStdin bool, archivePath string) int {
+	if useStdin {
+		for item := range streamStdin(cfg, os.Stdin) {
+			items = append(items, item)
+		}
+	}
+
+	var plan []plannedItem
+	number := 0
+	seen := make(map[string]string) // key -> what a repeat of it duplicates
+	var add func(item workItem)
+	add = func(item workItem) {
+		if item.Key == "" {
+			item.Key = canonicalKey(item.Identifier)
+		}
+		if first, exists := seen[item.Key]; exists {
+			plan = append(plan, plannedItem{workItem: item, Action: "skip", Reason: "duplicate of " + first})
+			return
+		}
+
+		if isPlaylistKey(item.Key) && !archivedPlaylist(cfg, item) {
+			// Recorded before expanding, so a playlist that lists itself
+			// is caught like any other duplicate.
+			seen[item.Key] = "playlist"
+			videos, err := expandPlaylist(ctx, item)
+			if err == nil {
+				before := number
+				for _, video := range videos {
+					add(video)
+				}
+				if number > before {
+					seen[item.Key] = fmt.Sprintf("playlist #%d-#%d", before+1, number)
+				}
+				return
+			}
+			item.Err = err
+		}
+
+		number++
+		item.ItemNumber = number
+		seen[item.Key] = fmt.Sprintf("#%d", number)
+		plan = append(plan, planItem(cfg, item, archivePath))
+	}
+	for _, item := range items {
+		add(item)
+	}
+
+	resolveOutputs(ctx, cfg, plan)
+	printPlan(plan)
+	return exitOK
+}
+
+func planItem(cfg *Config, item workItem, archivePath string) plannedItem {
+	p := plannedItem{workItem: item, Action: "skip"}
+	switch {
+	case item.Err != nil:
+		p.Action, p.Reason = "error", item.Err.Error()
+		return p
+	case !cfg.NoArchive && processedArchive.has(item.Key):
+		p.Reason = "archived"
+		return p
+	case !cfg.NoArchive && !cfg.ArchiveReadonly && claimedElsewhere(archivePath, item.Key):
+		p.Reason = "claimed by another run"
+		return p
+	}
+
+	p.Action = "download"
+	// The real info file is a temporary one created when the item starts.
+	p.Argv = append([]string{"yt-dlp"}, buildYtdlpArgs(cfg, item, "<info file>")...)
+	return p
+}
+
+// resolveOutputs asks yt-dlp for the path each download would be written
+// to, jobs items at a time. Where it can't tell, the plan shows the
+// template instead.
+func resolveOutputs(ctx context.Context, cfg *Config, plan []plannedItem) {
+	slots := make(chan struct{}, max(cfg.Jobs, 1))
+	var wg sync.WaitGroup
+	for i := range plan {
+		p := &plan[i]
+		if p.Action != "download" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			path, err := resolveOutputPath(ctx, cfg, p.workItem)
+			if err != nil {
+				mainTemplate, _ := outputTemplates(cfg, p.workItem)
+				outputDir := filepath.Join(cfg.OutputDir, p.Subdir)
+				path = fmt.Sprintf("%s (template; %v)", expandTemplate(cfg, p.workItem, outputDir, mainTemplate), err)
+			}
+			p.Output = path
+		}()
+	}
+	wg.Wait()
+}
+
+// resolveOutputPath runs yt-dlp with the item's real arguments plus
+// --simulate --print filename. yt-dlp names the file before extracting
+// audio, so the extension is the audio format's when the profile has one.
+func resolveOutputPath(ctx context.Context, cfg *Config, item workItem) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+
+	args := buildYtdlpArgs(cfg, item, os.DevNull)
+	last := len(args) - 1
+	args = append(args[:last:last], "--simulate", "--print", "filename", "--no-warnings", args[last])
+	cmd := exec.CommandContext(ctx, "yt-dlp", args...)
+	configureChildProcess(cmd)
+
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			if msg := lastErrorLine(string(exitErr.Stderr)); msg != "" {
+				return "", errors.New(msg)
+			}
+		}
+		return "", err
+	}
+	path := lastLine(string(out))
+	if path == "" {
+		return "", errors.New("yt-dlp printed no file name")
+	}
+	if format := item.Profile.AudioFormat; format != "" && format != "best" {
+		path = strings.TrimSuffix(path, filepath.Ext(path)) + "." + format
+	}
+	return path, nil
+}
+
+func printPlan(plan []plannedItem) {
+	counts := make(map[string]int)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tACTION\tPROFILE\tID\tOUTPUT / REASON")
+	for _, p := range plan {
+		counts[p.Action]++
+		number := "-"
+		if p.ItemNumber > 0 {
+			number = fmt.Sprint(p.ItemNumber)
+		}
+		detail := p.Output
+		if p.Action != "download" {
+			detail = p.Reason
+		}
+		profile := "-"
+		if p.Profile != nil {
+			profile = p.Profile.Name
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", number, p.Action, profile, p.Key, detail)
+	}
+	w.Flush()
+
+	if counts["download"] > 0 {
+		fmt.Println("\nCommands:")
+		for _, p := range plan {
+			if p.Action == "download" {
+				fmt.Printf("  [%d] %s\n", p.ItemNumber, shellQuote(p.Argv))
+			}
+		}
+	}
+
+	fmt.Printf("\nDry run: %d to download, %d skipped, %d errors. Nothing was downloaded or written.\n",
+		counts["download"], counts["skip"], counts["error"])
+}
+
+// shellQuote joins args into a line that can be pasted into a POSIX shell.
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.IndexFunc(arg, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=@%+,", r))
+		}) < 0 {
+			quoted[i] = arg
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// claimedElsewhere reports whether another process holds the claim for key,
+// without creating any claim files.
+func claimedElsewhere(archivePath, key string) bool {
+	path := claimPath(archivePath, key)
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	file, err := lockFile(path, false)
+	if err != nil {
+		return errors.Is(err, errLocked)
+	}
+	file.Close()
+	return false
+}
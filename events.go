@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	eventsNDJSON = "ndjson"
+	reportFormat = "multidl-report"
+)
+
+// Statuses of a finished item, shared by the events, the report and the
+// playlist tallies.
+const (
+	statusProcessed  = "processed"
+	statusSkipped    = "skipped"
+	statusFailed     = "failed"
+	statusNotStarted = "not started"
+	statusKilled     = "killed"
+)
+
+// event is one line of the --events stream.
+type event struct {
+	Event      string        `json:"event"`
+	Time       time.Time     `json:"time"`
+	Item       int           `json:"item"`
+	Identifier string        `json:"identifier"`
+	ID         string        `json:"id,omitempty"`
+	Playlist   string        `json:"playlist,omitempty"`
+	Status     string        `json:"status,omitempty"`
+	Percent    *float64      `json:"percent,omitempty"`
+	Speed      string        `json:"speed,omitempty"`
+	ETA        string        `json:"eta,omitempty"`
+	ErrorClass errorClass    `json:"error_class,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Attempts   int           `json:"attempts,omitempty"`
+	Duration   float64       `json:"duration,omitempty"` // seconds
+	Files      []archiveFile `json:"files,omitempty"`
+}
+
+// eventSink writes events as NDJSON. A nil sink drops them, so callers
+// don't check whether --events is on.
+type eventSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+var events *eventSink
+
+// openEvents sets up the event stream on the file descriptor fd. When that
+// is stdout, the human-readable output moves to stderr so the stream stays
+// parseable.
+func openEvents(cfg *Config) (*eventSink, error) {
+	switch cfg.Events {
+	case "":
+		return nil, nil
+	case eventsNDJSON:
+	default:
+		return nil, fmt.Errorf("events: expected ndjson, got %q", cfg.Events)
+	}
+
+	out := os.NewFile(uintptr(cfg.EventsFD), fmt.Sprintf("fd %d", cfg.EventsFD))
+	if out == nil {
+		return nil, fmt.Errorf("events: invalid file descriptor %d", cfg.EventsFD)
+	}
+	if _, err := out.Stat(); err != nil {
+		return nil, fmt.Errorf("events: %w", err)
+	}
+	if cfg.EventsFD == 1 {
+		os.Stdout = os.Stderr
+	}
+	return &eventSink{enc: json.NewEncoder(out)}, nil
+}
+
+func (s *eventSink) emit(e event) {
+	if s == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enc.Encode(e)
+}
+
+func (s *eventSink) item(name string, item workItem) {
+	if s == nil {
+		return
+	}
+	e := event{Event: name, Item: item.ItemNumber, Identifier: item.Identifier, ID: item.Key}
+	if item.Playlist != nil {
+		e.Playlist = item.Playlist.Key
+	}
+	s.emit(e)
+}
+
+func (s *eventSink) progress(v *itemView) {
+	if s == nil {
+		return
+	}
+	percent := v.percent
+	s.emit(event{Event: "progress", Item: v.item.ItemNumber, Identifier: v.item.Identifier, ID: v.item.Key,
+		Percent: &percent, Speed: v.speed, ETA: v.eta})
+}
+
+// finished emits the final event of an item: "finished", "skipped" or
+// "failed", with the exact status alongside.
+func (s *eventSink) finished(result processingResult, status string) {
+	if s == nil {
+		return
+	}
+	name := "failed"
+	switch status {
+	case statusProcessed:
+		name = "finished"
+	case statusSkipped, statusNotStarted:
+		name = "skipped"
+	}
+	e := reportItemFor(result, status)
+	s.emit(event{Event: name, Item: result.ItemNumber, Identifier: result.Identifier, ID: result.Key,
+		Status: status, ErrorClass: e.ErrorClass, Error: e.Error, Attempts: result.Attempts,
+		Duration: e.Duration, Files: result.Files})
+}
+
+// report is the --report file, written once the run is over.
+type report struct {
+	Format      string       `json:"format"`
+	Version     string       `json:"tool_version"`
+	StartedAt   time.Time    `json:"started_at"`
+	FinishedAt  time.Time    `json:"finished_at"`
+	Interrupted bool         `json:"interrupted"`
+	Counts      reportCounts `json:"counts"`
+	Items       []reportItem `json:"items"`
+}
+
+type reportCounts struct {
+	Total      int64  `json:"total"`
+	Processed  uint64 `json:"processed"`
+	Skipped    uint64 `json:"skipped"`
+	Failed     uint64 `json:"failed"`
+	NotStarted uint64 `json:"not_started"`
+	Killed     uint64 `json:"killed"`
+}
+
+type reportItem struct {
+	Item       int           `json:"item"`
+	Identifier string        `json:"identifier"`
+	ID         string        `json:"id,omitempty"`
+	Playlist   string        `json:"playlist,omitempty"`
+	Status     string        `json:"status"`
+	ErrorClass errorClass    `json:"error_class,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Attempts   int           `json:"attempts"`
+	Duration   float64       `json:"duration"` // seconds
+	Files      []archiveFile `json:"files"`
+	Log        string        `json:"log,omitempty"`
+}
+
+var reportItems []reportItem // main goroutine only
+
+func reportItemFor(result processingResult, status string) reportItem {
+	item := reportItem{
+		Item:       result.ItemNumber,
+		Identifier: result.Identifier,
+		ID:         result.Key,
+		Status:     status,
+		ErrorClass: result.ErrorClass,
+		Attempts:   result.Attempts,
+		Duration:   result.Duration.Round(time.Millisecond).Seconds(),
+		Files:      result.Files,
+		Log:        result.LogPath,
+	}
+	if item.Files == nil {
+		item.Files = []archiveFile{}
+	}
+	if result.Playlist != nil {
+		item.Playlist = result.Playlist.Key
+	}
+	switch {
+	case result.ArchiveErr != nil:
+		item.Error = "archive: " + result.ArchiveErr.Error()
+	case result.Error != nil && status != statusSkipped:
+		item.Error = result.Error.Error()
+	}
+	return item
+}
+
+// recordResult feeds a handled result to the event stream and the report.
+func recordResult(result processingResult, status string) {
+	events.finished(result, status)
+	reportItems = append(reportItems, reportItemFor(result, status))
+}
+
+func writeReport(path string, interrupted bool) error {
+	r := report{
+		Format:      reportFormat,
+		Version:     toolVersion,
+		StartedAt:   startTime.UTC(),
+		FinishedAt:  time.Now().UTC(),
+		Interrupted: interrupted,
+		Counts: reportCounts{
+			Total:      totalItems.Load(),
+			Processed:  processedCount.Load(),
+			Skipped:    skippedCount.Load(),
+			Failed:     errorCount.Load(),
+			NotStarted: notStartedCount.Load(),
+			Killed:     killedCount.Load(),
+		},
+		Items: reportItems,
+	}
+	if r.Items == nil {
+		r.Items = []reportItem{}
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,3 @@
+module github.com/monsieurr/multidl-ytdlp
+
+go 1.24
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const stdinName = "-"
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+// inputOptions are the per-line options a batch file or stdin line may carry
+// after the identifier, e.g. "URL profile=video-720p dir=Live".
+var inputOptions = []string{"profile", "dir", "chapters"}
+
+// parseInputLine turns one line of a batch file into a work item. Blank
+// lines and # comments yield ok == false. The identifier may carry a
+// PROFILE: prefix; trailing key=value fields set per-item options.
+func parseInputLine(cfg *Config, line string) (item workItem, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if i := strings.Index(line, " #"); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return workItem{}, false, nil
+	}
+
+	fields := strings.Fields(line)
+	options := make(map[string]string)
+	for len(fields) > 1 {
+		key, value, found := strings.Cut(fields[len(fields)-1], "=")
+		if !found || !slices.Contains(inputOptions, key) {
+			break
+		}
+		options[key] = value
+		fields = fields[:len(fields)-1]
+	}
+
+	item.Profile, item.Identifier = splitProfilePrefix(cfg, strings.Join(fields, " "))
+	if name, set := options["profile"]; set {
+		p, known := cfg.Profiles[name]
+		if !known {
+			return workItem{}, false, fmt.Errorf("unknown profile %q", name)
+		}
+		item.Profile = p
+	}
+	if dir, set := options["dir"]; set {
+		if filepath.IsAbs(dir) || !filepath.IsLocal(dir) {
+			return workItem{}, false, fmt.Errorf("dir %q must be a relative path inside the output directory", dir)
+		}
+		item.Subdir = filepath.Clean(dir)
+	}
+	if file, set := options["chapters"]; set {
+		if _, err := os.Stat(file); err != nil {
+			return workItem{}, false, fmt.Errorf("chapter file: %w", err)
+		}
+		item.ChapterFile = file
+	}
+	return item, true, nil
+}
+
+// collectInputs gathers the items from the command line and batch files.
+// It reports whether stdin was requested; stdin is streamed separately by
+// streamStdin so items start as they arrive.
+func collectInputs(cfg *Config) (items []workItem, useStdin bool, err error) {
+	for _, arg := range cfg.Args {
+		if arg == stdinName {
+			useStdin = true
+			continue
+		}
+		item := workItem{}
+		item.Profile, item.Identifier = splitProfilePrefix(cfg, strings.TrimSpace(arg))
+		if item.Identifier != "" {
+			items = append(items, item)
+		}
+	}
+
+	for _, path := range cfg.BatchFiles {
+		if path == stdinName {
+			useStdin = true
+			continue
+		}
+		fileItems, err := readBatchFile(cfg, path)
+		if err != nil {
+			return nil, false, err
+		}
+		items = append(items, fileItems...)
+	}
+	return items, useStdin, nil
+}
+
+func readBatchFile(cfg *Config, path string) ([]workItem, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("batch file: %w", err)
+	}
+	defer file.Close()
+
+	var items []workItem
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		item, ok, err := parseInputLine(cfg, scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		if ok {
+			items = append(items, item)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("batch file %s: %w", path, err)
+	}
+	return items, nil
+}
+
+// streamStdin parses lines from r as they arrive. Bad lines are reported
+// and skipped rather than aborting a run that is already underway.
+func streamStdin(cfg *Config, r io.Reader) <-chan workItem {
+	out := make(chan workItem)
+	go func() {
+		defer close(out)
+		scanner := bufio.NewScanner(r)
+		lineNo := 0
+		for scanner.Scan() {
+			lineNo++
+			item, ok, err := parseInputLine(cfg, scanner.Text())
+			if err != nil {
+				log.Printf("WARN: stdin:%d: %v", lineNo, err)
+				continue
+			}
+			if ok {
+				out <- item
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Printf("WARN: reading stdin: %v", err)
+		}
+	}()
+	return out
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	errLocked           = errors.New("locked by another process")
+	errClaimedElsewhere = errors.New("skipped (claimed elsewhere)")
+)
+
+// withArchiveLock runs fn holding the cross-process lock on the archive at
+// path. Callers hold processedArchive's mutex first, so in-process and
+// cross-process locking always nest the same way.
+func withArchiveLock(path string, fn func() error) error {
+	lock, err := lockFile(path+".lock", true)
+	if err != nil {
+		return fmt.Errorf("archive lock failed: %w", err)
+	}
+	defer lock.Close()
+	return fn()
+}
+
+// itemClaim marks an item as being downloaded by this process, so another
+// run sharing the archive skips it instead of downloading it twice.
+type itemClaim struct {
+	file *os.File
+}
+
+func claimsDir(archivePath string) string {
+	return archivePath + ".claims"
+}
+
+func claimPath(archivePath, key string) string {
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(claimsDir(archivePath), hex.EncodeToString(sum[:]))
+}
+
+// claimItem takes the claim for key, failing with errLocked if another
+// process holds it. Claims are flocks on one file per key, so those left by
+// a crashed process are released by the kernel and simply taken over.
+func claimItem(archivePath, key string) (*itemClaim, error) {
+	if err := os.MkdirAll(claimsDir(archivePath), 0755); err != nil {
+		return nil, err
+	}
+
+	path := claimPath(archivePath, key)
+	var file *os.File
+	for {
+		var err error
+		if file, err = lockFile(path, false); err != nil {
+			return nil, err
+		}
+		// The previous holder removes the file on release. If it did so
+		// between our open and our lock, we hold a lock on a file nobody
+		// else can see, so try again with whatever is at path now.
+		current, err := isCurrentFile(file, path)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if current {
+			break
+		}
+		file.Close()
+	}
+
+	hostname, _ := os.Hostname()
+	file.Truncate(0)
+	fmt.Fprintf(file, "%s\npid %d on %s since %s\n", key, os.Getpid(), hostname, time.Now().Format(time.RFC3339))
+	return &itemClaim{file: file}, nil
+}
+
+// isCurrentFile reports whether file is still the one at path.
+func isCurrentFile(file *os.File, path string) (bool, error) {
+	opened, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	named, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(opened, named), nil
+}
+
+// release removes the claim file while still holding its lock, so the
+// claims directory only holds items in progress, then drops the lock.
+// claimItem copes with a file removed under it.
+func (c *itemClaim) release() {
+	os.Remove(c.file.Name())
+	c.file.Close()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClaimRelease(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "archive.jsonl")
+	key := "youtube:h8htSF9X5sE"
+
+	for range 2 {
+		claim, err := claimItem(archive, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(claimPath(archive, key)); err != nil {
+			t.Fatalf("claim file missing while held: %v", err)
+		}
+		claim.release()
+		if _, err := os.Stat(claimPath(archive, key)); !os.IsNotExist(err) {
+			t.Fatalf("claim file left after release: %v", err)
+		}
+	}
+}
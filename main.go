@@ -1,14 +1,20 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -16,173 +22,705 @@ import (
 	"time"
 )
 
-const (
-	outputBaseDir   = "."
-	archiveFilename = "ytmp3_processed_archive.txt"
-)
-
 type SafeSet struct {
 	sync.Mutex
 	m map[string]struct{}
 }
 
+type workItem struct {
+	Identifier  string
+	Key         string // canonicalKey(Identifier)
+	ItemNumber  int
+	Profile     *Profile
+	Subdir      string // relative to the output directory
+	Title       string // known up front for playlist entries
+	ChapterFile string // chapters to split by instead of the video's own
+
+	Playlist      *playlistInfo // set on items expanded from a playlist
+	PlaylistIndex int
+	Err           error // set when the item cannot be processed at all
+}
+
 type processingResult struct {
-	Identifier string
-	ItemNumber int
-	Error      error
-	ArchiveErr error
-	StartTime  time.Time
-	Duration   time.Duration
+	Identifier    string
+	Key           string
+	ItemNumber    int
+	Playlist      *playlistInfo
+	PlaylistIndex int
+	Error         error
+	ArchiveErr    error
+	ErrorClass    errorClass
+	Attempts      int
+	LogPath       string          // raw yt-dlp output, if logging to files
+	Files         []archiveFile   // output files, checked if verifying
+	Tracks        []playlistTrack // media files in play order, for playlist files
+	StartTime     time.Time
+	Duration      time.Duration
 }
 
+// Exit codes, documented in printUsage and the README.
+const (
+	exitOK          = 0
+	exitPartial     = 1 // some items failed
+	exitAllFailed   = 2
+	exitUsage       = 3 // bad config, arguments or setup
+	exitDependency  = 4 // yt-dlp or another required tool is missing
+	exitInterrupted = 130
+)
+
+var (
+	errNotStarted = errors.New("not started (interrupted)")
+	errKilled     = errors.New("killed (aborted)")
+	errArchived   = errors.New("skipped (archived)")
+	errDuplicate  = errors.New("skipped (duplicate in progress)")
+)
+
 var (
 	processedCount   atomic.Uint64
 	skippedCount     atomic.Uint64
 	errorCount       atomic.Uint64
-	totalItems       int
+	notStartedCount  atomic.Uint64
+	killedCount      atomic.Uint64
+	totalItems       atomic.Int64
+	inputOpen        atomic.Bool // stdin may still add items
 	startTime        time.Time
-	processedArchive SafeSet
+	processedArchive Archive
 	pending          SafeSet
 	shutdownSignal   = make(chan os.Signal, 1)
 	outputMutex      sync.Mutex
+	errorClassCounts = make(map[errorClass]int) // main goroutine only
+	writtenResults   []processingResult         // main goroutine only: results with output files
+	bytesWritten     int64                      // main goroutine only
 )
 
 func main() {
 	log.SetFlags(0)
 	startTime = time.Now()
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "config":
+			os.Exit(runConfigCommand(os.Args[2:]))
+		case "archive":
+			os.Exit(runArchiveCommand(os.Args[2:]))
+		case "doctor":
+			os.Exit(runDoctor(os.Args[2:]))
+		}
+	}
+	os.Exit(run())
+}
+
+// run processes the items on the command line and returns the exit code.
+// It returns rather than exiting so its deferred summary and report run.
+func run() int {
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		printUsage()
+		return exitOK
+	}
+	if err != nil {
+		log.Printf("FATAL: %v", err)
+		printUsage()
+		return exitUsage
+	}
+	if events, err = openEvents(cfg); err != nil {
+		log.Printf("FATAL: %v", err)
+		return exitUsage
+	}
+
+	items, useStdin, err := collectInputs(cfg)
+	if err != nil {
+		log.Printf("FATAL: %v", err)
+		return exitUsage
+	}
+	if len(items) == 0 && !useStdin {
+		printUsage()
+		return exitUsage
+	}
+	if err := checkDependencies(cfg); err != nil {
+		log.Printf("FATAL: %v", err)
+		return exitDependency
+	}
+
 	signal.Notify(shutdownSignal, syscall.SIGINT, syscall.SIGTERM)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	draining := make(chan struct{})
+	go watchSignals(draining, cancel)
 
-	exePath, err := os.Executable()
+	archivePath, err := resolveArchivePath(cfg)
 	if err != nil {
-		log.Fatalf("FATAL: Could not determine executable path: %v", err)
+		log.Printf("FATAL: %v", err)
+		return exitUsage
+	}
+	if !cfg.NoArchive {
+		if err := initArchive(archivePath, cfg.ArchiveReadonly || cfg.DryRun); err != nil {
+			log.Printf("FATAL: Archive initialization failed: %v", err)
+			return exitUsage
+		}
 	}
-	archivePath := filepath.Join(filepath.Dir(exePath), archiveFilename)
 
-	if err := initArchive(archivePath); err != nil {
-		log.Fatalf("FATAL: Archive initialization failed: %v", err)
+	if cfg.DryRun {
+		return runDryRun(ctx, cfg, items, useStdin, archivePath)
 	}
 
-	args := deduplicateArgs(os.Args[1:])
-	totalItems = len(args)
-	if totalItems == 0 {
-		printUsage()
-		os.Exit(1)
+	// Everything but stdin is resolved up front, so the total is known
+	// before the first item starts.
+	seen := make(map[string]struct{})
+	inputOpen.Store(useStdin)
+	items = resolveItems(ctx, cfg, items, seen, draining)
+
+	jobs := max(cfg.Jobs, 1)
+	if useStdin {
+		fmt.Printf("Starting processing with %d workers at %s, reading items from stdin\n\n", jobs, startTime.Format("15:04:05"))
+	} else {
+		jobs = max(min(jobs, len(items)), 1)
+		fmt.Printf("Starting processing for %d items with %d workers at %s\n\n", len(items), jobs, startTime.Format("15:04:05"))
 	}
 
-	fmt.Printf("Starting processing for %d items at %s\n\n", totalItems, startTime.Format("15:04:05"))
+	if disp, err = newDisplay(cfg); err != nil {
+		log.Printf("FATAL: %v", err)
+		return exitUsage
+	}
+	runLogs, err := setupLogging(cfg)
+	if err != nil {
+		log.Printf("FATAL: %v", err)
+		return exitUsage
+	}
+	defer runLogs.close()
+	log.SetOutput(runLogs.writer(disp.logWriter()))
 
+	audioSlots = make(chan struct{}, cfg.AudioJobs)
 	var wg sync.WaitGroup
-	results := make(chan processingResult, totalItems)
+	queue := make(chan workItem)
+	results := make(chan processingResult, jobs)
 
-	for i, identifier := range args {
+	for w := 0; w < jobs; w++ {
 		wg.Add(1)
-		go processVideo(ctx, &wg, identifier, archivePath, i+1, results)
+		go worker(ctx, cfg, &wg, queue, draining, archivePath, runLogs, results)
 	}
 
+	go feedQueue(ctx, cfg, items, seen, useStdin, queue, draining)
+
 	go func() {
 		wg.Wait()
 		close(results)
 	}()
 
 	var interrupted bool
-	defer func() { printSummary(interrupted) }()
+	defer func() {
+		writeYouTubePlaylists(cfg)
+		printSummary(interrupted)
+		if cfg.Report == "" {
+			return
+		}
+		if err := writeReport(cfg.Report, interrupted); err != nil {
+			log.Printf("WARN: failed to write report: %v", err)
+		}
+	}()
+	defer func() {
+		disp.stop()
+		log.SetOutput(runLogs.writer(os.Stderr))
+	}()
 
 	for result := range results {
 		handleProcessingResult(result, archivePath)
 	}
+
+	interrupted = isDraining(draining)
+	return exitStatus(interrupted, cfg.FailOnSkip)
+}
+
+// exitStatus derives the exit code from the final counts. Skipped items
+// count as successes unless failOnSkip is set.
+func exitStatus(interrupted, failOnSkip bool) int {
+	if interrupted {
+		return exitInterrupted
+	}
+	ok := processedCount.Load()
+	failed := errorCount.Load() + killedCount.Load()
+	if failOnSkip {
+		failed += skippedCount.Load()
+	} else {
+		ok += skippedCount.Load()
+	}
+	switch {
+	case failed == 0:
+		return exitOK
+	case ok == 0:
+		return exitAllFailed
+	}
+	return exitPartial
 }
 
-func initArchive(path string) error {
-	processedArchive = SafeSet{m: make(map[string]struct{})}
+// watchSignals stops new items from starting on the first signal and kills
+// the running downloads on the second.
+func watchSignals(draining chan<- struct{}, cancel context.CancelFunc) {
+	sig := <-shutdownSignal
+	close(draining)
+	log.Printf("\nReceived %v: letting running items finish, no new items will start (repeat to abort)", sig)
 
-	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open archive: %w", err)
+	sig = <-shutdownSignal
+	log.Printf("\nReceived %v again: killing running downloads", sig)
+	cancel()
+}
+
+// resolveItems deduplicates items against seen, expands playlists into
+// their videos and numbers the result.
+func resolveItems(ctx context.Context, cfg *Config, items []workItem, seen map[string]struct{}, draining <-chan struct{}) []workItem {
+	var resolved []workItem
+	var add func(item workItem)
+	add = func(item workItem) {
+		if item.Key == "" {
+			item.Key = canonicalKey(item.Identifier)
+		}
+		if _, exists := seen[item.Key]; exists {
+			return
+		}
+		seen[item.Key] = struct{}{}
+
+		if isPlaylistKey(item.Key) && !isDraining(draining) && !archivedPlaylist(cfg, item) {
+			videos, err := expandPlaylist(ctx, item)
+			if err == nil {
+				log.Printf("Expanded playlist %s: %d videos", item.Identifier, len(videos))
+				for _, video := range videos {
+					add(video)
+				}
+				return
+			}
+			item.Err = err
+		}
+
+		item.ItemNumber = int(totalItems.Add(1))
+		resolved = append(resolved, item)
 	}
-	defer file.Close()
+	for _, item := range items {
+		add(item)
+	}
+	return resolved
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line != "" {
-			processedArchive.m[line] = struct{}{}
+// feedQueue hands the resolved items to the workers. Items from stdin are
+// resolved and queued as they arrive, until the input ends or a shutdown
+// begins; until then the total is not known.
+func feedQueue(ctx context.Context, cfg *Config, items []workItem, seen map[string]struct{}, useStdin bool, queue chan<- workItem, draining <-chan struct{}) {
+	defer close(queue)
+	defer inputOpen.Store(false)
+
+	enqueue := func(items []workItem) {
+		for _, item := range items {
+			events.item("queued", item)
+			queue <- item
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("archive read error: %w", err)
+	enqueue(items)
+	if !useStdin {
+		return
+	}
+
+	lines := streamStdin(cfg, os.Stdin)
+	for {
+		select {
+		case item, ok := <-lines:
+			if !ok {
+				return
+			}
+			enqueue(resolveItems(ctx, cfg, []workItem{item}, seen, draining))
+		case <-draining:
+			return
+		}
+	}
+}
+
+// itemCount shows item number n out of the total, or on its own while
+// stdin may still add items.
+func itemCount(n uint64) string {
+	if inputOpen.Load() {
+		return strconv.FormatUint(n, 10)
+	}
+	return fmt.Sprintf("%d/%d", n, totalItems.Load())
+}
+
+// defaultJobs picks a worker count from the CPU count, capped so a large
+// batch doesn't get us rate-limited.
+func defaultJobs() int {
+	n := runtime.NumCPU()
+	if n > 4 {
+		n = 4
+	}
+	return n
+}
+
+func isDraining(draining <-chan struct{}) bool {
+	select {
+	case <-draining:
+		return true
+	default:
+		return false
 	}
-	return nil
 }
 
-func processVideo(ctx context.Context, wg *sync.WaitGroup, identifier, archivePath string, itemNumber int, results chan<- processingResult) {
+func worker(ctx context.Context, cfg *Config, wg *sync.WaitGroup, queue <-chan workItem, draining <-chan struct{}, archivePath string, runLogs *runLog, results chan<- processingResult) {
 	defer wg.Done()
+	for item := range queue {
+		switch {
+		case isDraining(draining):
+			results <- processingResult{
+				Identifier:    item.Identifier,
+				Key:           item.Key,
+				ItemNumber:    item.ItemNumber,
+				Playlist:      item.Playlist,
+				PlaylistIndex: item.PlaylistIndex,
+				Error:         errNotStarted,
+			}
+			continue
+		case item.Err != nil:
+			results <- processingResult{
+				Identifier:    item.Identifier,
+				Key:           item.Key,
+				ItemNumber:    item.ItemNumber,
+				Playlist:      item.Playlist,
+				PlaylistIndex: item.PlaylistIndex,
+				Error:         item.Err,
+			}
+			continue
+		}
+		processVideo(ctx, cfg, wg, item, draining, archivePath, runLogs, results)
+	}
+}
 
+func processVideo(ctx context.Context, cfg *Config, wg *sync.WaitGroup, item workItem, draining <-chan struct{}, archivePath string, runLogs *runLog, results chan<- processingResult) {
+	identifier := item.Identifier
 	result := processingResult{
-		Identifier: identifier,
-		ItemNumber: itemNumber,
-		StartTime:  time.Now(),
+		Identifier:    identifier,
+		Key:           item.Key,
+		ItemNumber:    item.ItemNumber,
+		Playlist:      item.Playlist,
+		PlaylistIndex: item.PlaylistIndex,
+		StartTime:     time.Now(),
 	}
 
-	defer func() {
+	// What the item holds is given back once it is done, here or, if it
+	// was handed to the audio stage, there.
+	var held []func()
+	handedOff := false
+	done := func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i]()
+		}
 		result.Duration = time.Since(result.StartTime)
 		results <- result
+	}
+	defer func() {
+		if !handedOff {
+			done()
+		}
 	}()
 
-	outputMutex.Lock()
-	fmt.Printf("\n╔════ ITEM %d/%d ════════════════════════════════\n", itemNumber, totalItems)
-	fmt.Printf("║ URL: %s\n", identifier)
-	fmt.Printf("║ Start: %s\n", result.StartTime.Format("15:04:05"))
-	fmt.Println("╚═══════════════════════════════════════════════")
-	outputMutex.Unlock()
+	view := disp.begin(item)
+	defer disp.end(view)
+	events.item("started", item)
 
-	if !markPending(identifier) {
-		result.Error = fmt.Errorf("duplicate in progress")
+	if !markPending(item.Key) {
+		result.Error = errDuplicate
 		return
 	}
-	defer unmarkPending(identifier)
+	held = append(held, func() { unmarkPending(item.Key) })
+
+	// A read-only archive is shared with runs we don't coordinate with,
+	// so only a writable one takes claims.
+	if !cfg.NoArchive && !cfg.ArchiveReadonly {
+		claim, err := claimItem(archivePath, item.Key)
+		if errors.Is(err, errLocked) {
+			result.Error = errClaimedElsewhere
+			return
+		}
+		if err != nil {
+			result.Error = fmt.Errorf("claim failed: %w", err)
+			return
+		}
+		held = append(held, claim.release)
+	}
 
-	processedArchive.Lock()
-	_, exists := processedArchive.m[identifier]
-	processedArchive.Unlock()
+	if !cfg.NoArchive {
+		if err := processedArchive.refresh(); err != nil {
+			log.Printf("WARN: archive reload failed: %v", err)
+		}
+		if processedArchive.has(item.Key) {
+			result.Error = errArchived
+			return
+		}
+	}
 
-	if exists {
-		result.Error = fmt.Errorf("skipped (archived)")
+	itemLog, logPath := runLogs.openItem(item)
+	defer itemLog.Close()
+	result.LogPath = logPath
+
+	infoFile, err := os.CreateTemp("", "multidl-info-*.json")
+	if err != nil {
+		result.Error = fmt.Errorf("failed to create info file: %w", err)
 		return
 	}
+	infoFile.Close()
+	defer os.Remove(infoFile.Name())
 
-	cmd := exec.CommandContext(ctx, "yt-dlp",
-		"--color", "always",
-		"--progress",
-		"--newline",
-		"--progress-template", "[download] %(progress._percent_str)s of %(progress._total_bytes_str)s at %(progress._speed_str)s ETA %(progress._eta_str)s",
-		"--console-title",
-		"--extract-audio",
-		"--audio-format", "mp3",
-		"--audio-quality", "0",
-		"--split-chapters",
-		"--embed-thumbnail",
-		"-o", fmt.Sprintf("chapter:%s/%%(title)s/%%(section_title)s - %%(title)s.%%(ext)s", outputBaseDir),
-		identifier,
-	)
-
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		result.Error = fmt.Errorf("yt-dlp error: %w", err)
+	if err := downloadWithRetries(ctx, cfg, item, view, itemLog, infoFile.Name(), draining, &result); err != nil {
+		result.Error = err
+		return
+	}
+	media, err := checkOutputs(ctx, cfg, item, infoFile.Name())
+	if err != nil {
+		result.Files = describeFiles(allFiles(media))
+		result.Error = err
+		result.ErrorClass = classVerification
 		return
 	}
+	for i := range media {
+		m := &media[i]
+		m.files, m.sidecars, err = applyChapterMode(ctx, cfg, item, m.info, m.files)
+		if err != nil {
+			result.Files = describeFiles(allFiles(media))
+			result.Error = err
+			result.ErrorClass = classFFmpeg
+			if errors.Is(err, errVerification) {
+				result.ErrorClass = classVerification
+			}
+			return
+		}
+	}
 
-	if err := appendToArchive(archivePath, identifier); err != nil {
+	// The audio steps are CPU-bound and limited by audio_jobs rather than
+	// jobs, so they run apart from the download workers: this one moves on
+	// to its next item while the item waits for an audio slot, keeping its
+	// claim until it is archived.
+	if item.Profile.hasAudioSteps() {
+		handedOff = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			finishItem(ctx, cfg, item, media, archivePath, &result)
+			done()
+		}()
+		return
+	}
+	finishItem(ctx, cfg, item, media, archivePath, &result)
+}
+
+// finishItem runs what follows the download and chapter handling: the
+// audio steps, tagging and the playlist of each video, then archives the
+// item.
+func finishItem(ctx context.Context, cfg *Config, item workItem, media []itemMedia, archivePath string, result *processingResult) {
+	for i := range media {
+		m := &media[i]
+		if err := processAudio(ctx, cfg, item, m.files); err != nil {
+			result.Files = describeFiles(allFiles(media))
+			result.Error = err
+			result.ErrorClass = classFFmpeg
+			return
+		}
+		if cfg.Tag {
+			if err := tagFiles(ctx, cfg, item, m.info, m.files); err != nil {
+				result.Files = describeFiles(allFiles(media))
+				result.Error = err
+				result.ErrorClass = classFFmpeg
+				return
+			}
+		}
+		// Both steps rewrite the files verification passed, and trimming
+		// changes how long they play, so check them again before they are
+		// listed and archived.
+		if cfg.Verify && (item.Profile.hasAudioSteps() || cfg.Tag) {
+			found, err := verifyOutputs(ctx, cfg, item, m.files)
+			m.files = found
+			if err != nil {
+				result.Files = describeFiles(allFiles(media))
+				result.Error = err
+				result.ErrorClass = classVerification
+				return
+			}
+		}
+		if playlist, ok, err := writeItemPlaylist(cfg, m.info, m.files); err != nil {
+			log.Printf("WARN: [%d] %s - %v", item.ItemNumber, item.Identifier, err)
+		} else if ok {
+			m.sidecars = append(m.sidecars, playlist)
+		}
+		result.Tracks = append(result.Tracks, itemTracks(m.info, m.files)...)
+	}
+	result.Files = describeFiles(allFiles(media))
+	if cfg.NoArchive || cfg.ArchiveReadonly {
+		return
+	}
+
+	// Only playlist entries know their title up front.
+	title := item.Title
+	if title == "" && len(media) == 1 {
+		title = media[0].info.Title
+	}
+	entry := archiveEntry{
+		ID:          item.Key,
+		Input:       item.Identifier,
+		Title:       title,
+		CompletedAt: time.Now().UTC(),
+		Profile:     item.Profile.Name,
+		Files:       result.Files,
+		ToolVersion: toolVersion,
+	}
+	if err := appendToArchive(archivePath, entry); err != nil {
 		result.ArchiveErr = err
 	}
 }
 
-func markPending(identifier string) bool {
+// downloadWithRetries runs yt-dlp for item, retrying transient failures
+// with backoff until the retry budget is spent. Retries stop early once a
+// shutdown has begun.
+func downloadWithRetries(ctx context.Context, cfg *Config, item workItem, view *itemView, rawLog io.Writer, infoPath string, draining <-chan struct{}, result *processingResult) error {
+	args := buildYtdlpArgs(cfg, item, infoPath)
+	var stderr tailBuffer
+
+	for attempt := 1; ; attempt++ {
+		result.Attempts = attempt
+		stderr.Reset()
+		os.Truncate(infoPath, 0)
+		fmt.Fprintf(rawLog, "# attempt %d: yt-dlp %s\n", attempt, strings.Join(args, " "))
+
+		cmd := exec.CommandContext(ctx, "yt-dlp", args...)
+		cmd.Stdout = io.MultiWriter(view.Stdout, rawLog)
+		cmd.Stderr = io.MultiWriter(view.Stderr, rawLog, &stderr)
+		configureChildProcess(cmd)
+
+		err := cmd.Run()
+		if err == nil {
+			result.ErrorClass = ""
+			return nil
+		}
+		if ctx.Err() != nil {
+			return errKilled
+		}
+
+		result.ErrorClass = classifyFailure(err, stderr.String())
+		if msg := lastErrorLine(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		retries := result.ErrorClass.retries(cfg.Retries)
+		if attempt > retries || isDraining(draining) {
+			return fmt.Errorf("yt-dlp error: %w", err)
+		}
+
+		delay := retryDelay(cfg.RetryDelay, attempt, result.ErrorClass)
+		log.Printf("[%d] %s - %s error, retry %d/%d in %s", item.ItemNumber, item.Identifier,
+			result.ErrorClass, attempt, retries, delay.Round(100*time.Millisecond))
+
+		select {
+		case <-time.After(delay):
+		case <-draining:
+			return fmt.Errorf("yt-dlp error: %w", err)
+		case <-ctx.Done():
+			return errKilled
+		}
+	}
+}
+
+// checkOutputs reads what yt-dlp reported producing and, with verify on,
+// checks the files before the item may be archived. It returns the files
+// that exist even when verification fails.
+func checkOutputs(ctx context.Context, cfg *Config, item workItem, infoPath string) ([]itemMedia, error) {
+	infos, err := readMediaInfo(infoPath)
+	if err != nil {
+		if cfg.Verify {
+			return nil, fmt.Errorf("%w: %w", errVerification, err)
+		}
+		return nil, nil
+	}
+
+	media := make([]itemMedia, len(infos))
+	var expected []outputFile
+	var errs []error
+	for i, info := range infos {
+		media[i].info = info
+		files, err := info.expectedFiles()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		media[i].files = files
+		expected = append(expected, files...)
+	}
+
+	var found []outputFile
+	if cfg.Verify {
+		if len(errs) > 0 {
+			err = fmt.Errorf("%w: %w", errVerification, errors.Join(errs...))
+		} else {
+			found, err = verifyOutputs(ctx, cfg, item, expected)
+		}
+	} else {
+		for _, f := range expected {
+			if _, err := os.Stat(f.Path); err == nil {
+				found = append(found, f)
+			}
+		}
+	}
+	for i := range media {
+		media[i].files = slices.DeleteFunc(media[i].files, func(f outputFile) bool {
+			return !slices.ContainsFunc(found, func(g outputFile) bool { return g.Path == f.Path })
+		})
+	}
+	return media, err
+}
+
+// buildYtdlpArgs returns the yt-dlp arguments for item. yt-dlp reports the
+// files it produced to infoPath.
+func buildYtdlpArgs(cfg *Config, item workItem, infoPath string) []string {
+	profile := item.Profile
+	outputDir := filepath.Join(cfg.OutputDir, item.Subdir)
+
+	args := []string{
+		"--color", "never",
+		"--progress",
+		"--newline",
+		"--progress-template", progressTemplate,
+	}
+	if profile.Format != "" {
+		args = append(args, "-f", profile.Format)
+	}
+	if profile.AudioFormat != "" {
+		quality := profile.AudioQuality
+		if quality == "" {
+			quality = cfg.AudioQuality
+		}
+		args = append(args,
+			"--extract-audio",
+			"--audio-format", profile.AudioFormat,
+			"--audio-quality", quality,
+		)
+	}
+	args = append(args, profile.Args...)
+	if item.Playlist != nil {
+		args = append(args, "--no-playlist")
+	}
+
+	for _, step := range profile.PostProcess {
+		switch {
+		case step == "embed-thumbnail" && !cfg.EmbedThumbnail:
+		default:
+			args = append(args, postProcessSteps[step]...)
+		}
+	}
+
+	mainTemplate, _ := outputTemplates(cfg, item)
+	args = append(args, "-o", expandTemplate(cfg, item, outputDir, mainTemplate))
+	if cfg.WindowsFilenames {
+		args = append(args, "--windows-filenames")
+	}
+	if cfg.MaxFilenameLength > 0 {
+		args = append(args, "--trim-filenames", strconv.Itoa(cfg.MaxFilenameLength))
+	}
+	args = append(args, "--print-to-file", infoTemplate, infoPath)
+
+	return append(args, item.Identifier)
+}
+
+func markPending(key string) bool {
 	pending.Lock()
 	defer pending.Unlock()
 
@@ -190,70 +728,106 @@ func markPending(identifier string) bool {
 		pending.m = make(map[string]struct{})
 	}
 
-	if _, exists := pending.m[identifier]; exists {
+	if _, exists := pending.m[key]; exists {
 		return false
 	}
 
-	pending.m[identifier] = struct{}{}
+	pending.m[key] = struct{}{}
 	return true
 }
 
-func unmarkPending(identifier string) {
+func unmarkPending(key string) {
 	pending.Lock()
 	defer pending.Unlock()
-	delete(pending.m, identifier)
-}
-
-func appendToArchive(path string, identifier string) error {
-	processedArchive.Lock()
-	defer processedArchive.Unlock()
-
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
-	if err != nil {
-		return fmt.Errorf("archive open failed: %w", err)
-	}
-	defer file.Close()
-
-	if _, err := fmt.Fprintln(file, identifier); err != nil {
-		return fmt.Errorf("archive write failed: %w", err)
-	}
-
-	processedArchive.m[identifier] = struct{}{}
-	return nil
+	delete(pending.m, key)
 }
 
 func handleProcessingResult(result processingResult, archivePath string) {
 	baseMsg := fmt.Sprintf("[%d] %s (%s)",
 		result.ItemNumber, result.Identifier, result.Duration.Round(time.Second))
 
+	var status string
 	switch {
+	case errors.Is(result.Error, errNotStarted):
+		log.Printf("%s - Not started", baseMsg)
+		notStartedCount.Add(1)
+		status = statusNotStarted
+	case errors.Is(result.Error, errKilled):
+		log.Printf("%s - Killed", baseMsg)
+		killedCount.Add(1)
+		status = statusKilled
+	case errors.Is(result.Error, errClaimedElsewhere):
+		log.Printf("%s - Skipped (claimed elsewhere)", baseMsg)
+		skippedCount.Add(1)
+		status = statusSkipped
 	case result.ArchiveErr != nil:
 		log.Printf("%s - Archive Error: %v", baseMsg, result.ArchiveErr)
 		errorCount.Add(1)
+		status = statusFailed
+	case errors.Is(result.Error, errArchived), errors.Is(result.Error, errDuplicate):
+		log.Printf("%s - Skipped", baseMsg)
+		skippedCount.Add(1)
+		status = statusSkipped
 	case result.Error != nil:
-		if strings.Contains(result.Error.Error(), "skipped") {
-			log.Printf("%s - Skipped", baseMsg)
-			skippedCount.Add(1)
-		} else {
-			log.Printf("%s - Failed: %v", baseMsg, result.Error)
-			errorCount.Add(1)
-		}
+		log.Printf("%s - Failed%s: %v%s", baseMsg, failureDetail(result), result.Error, logHint(result))
+		errorCount.Add(1)
+		errorClassCounts[result.ErrorClass]++
+		status = statusFailed
 	default:
-		log.Printf("%s - Success", baseMsg)
+		log.Printf("%s - Success%s", baseMsg, filesDetail(result.Files))
 		processedCount.Add(1)
+		status = statusProcessed
 	}
+
+	if len(result.Files) > 0 {
+		writtenResults = append(writtenResults, result)
+		bytesWritten += filesSize(result.Files)
+	}
+
+	tallyPlaylistResult(result, status)
+	recordResult(result, status)
 }
 
-func deduplicateArgs(args []string) []string {
-	seen := make(map[string]struct{})
-	unique := make([]string, 0, len(args))
-	for _, arg := range args {
-		if _, exists := seen[arg]; !exists {
-			seen[arg] = struct{}{}
-			unique = append(unique, arg)
-		}
+// filesDetail describes an item's output, e.g. " (3 files, 41.2 MiB)".
+func filesDetail(files []archiveFile) string {
+	switch len(files) {
+	case 0:
+		return ""
+	case 1:
+		return fmt.Sprintf(" (1 file, %s)", formatBytes(filesSize(files)))
 	}
-	return unique
+	return fmt.Sprintf(" (%d files, %s)", len(files), formatBytes(filesSize(files)))
+}
+
+func filesSize(files []archiveFile) int64 {
+	var n int64
+	for _, f := range files {
+		n += f.Size
+	}
+	return n
+}
+
+func logHint(result processingResult) string {
+	if result.LogPath == "" {
+		return ""
+	}
+	return " (log: " + result.LogPath + ")"
+}
+
+// failureDetail describes the error class and attempt count of a failed
+// result, e.g. " [network, 4 attempts]".
+func failureDetail(result processingResult) string {
+	var parts []string
+	if result.ErrorClass != "" {
+		parts = append(parts, string(result.ErrorClass))
+	}
+	if result.Attempts > 1 {
+		parts = append(parts, fmt.Sprintf("%d attempts", result.Attempts))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " [" + strings.Join(parts, ", ") + "]"
 }
 
 func printSummary(interrupted bool) {
@@ -267,22 +841,130 @@ func printSummary(interrupted bool) {
 	}
 
 	fmt.Println("═══════════════════════════════════════════════")
-	fmt.Printf("  Total items submitted:   %d\n", totalItems)
+	fmt.Printf("  Total items submitted:   %d\n", totalItems.Load())
 	fmt.Printf("  Successfully processed:  %d\n", processedCount.Load())
 	fmt.Printf("  Skipped (archived):      %d\n", skippedCount.Load())
 	fmt.Printf("  Errors:                  %d\n", errorCount.Load())
+	for _, class := range slices.Sorted(maps.Keys(errorClassCounts)) {
+		name := string(class)
+		if name == "" {
+			name = "other"
+		}
+		fmt.Printf("    %-22s %d\n", name+":", errorClassCounts[class])
+	}
+	if interrupted {
+		fmt.Printf("  Not started:             %d\n", notStartedCount.Load())
+		fmt.Printf("  Killed:                  %d\n", killedCount.Load())
+	}
+	fmt.Printf("  Bytes written:           %s\n", formatBytes(bytesWritten))
 	fmt.Printf("  Total duration:          %s\n", elapsed.Round(time.Second))
+	printPlaylistSummary()
+	printFilesSummary()
 	fmt.Println("═══════════════════════════════════════════════")
 }
 
+func printFilesSummary() {
+	if len(writtenResults) == 0 {
+		return
+	}
+	cwd, _ := os.Getwd()
+
+	fmt.Println("  Files:")
+	for _, result := range writtenResults {
+		fmt.Printf("    [%d] %s%s\n", result.ItemNumber, result.Identifier, filesDetail(result.Files))
+		for _, f := range result.Files {
+			path := f.Path
+			if rel, err := filepath.Rel(cwd, path); err == nil && filepath.IsLocal(rel) {
+				path = rel
+			}
+			fmt.Printf("      %s (%s)\n", path, formatBytes(f.Size))
+		}
+	}
+}
+
 func printUsage() {
+	prog := filepath.Base(os.Args[0])
 	fmt.Printf(`
-Usage: %s [URL/ID...]
+Usage: %s [OPTIONS] [[PROFILE:]URL/ID...] [-]
+       %s config show [OPTIONS]
+       %s archive list|grep|rm|prune|stats|export ...
+       %s doctor [OPTIONS]
 
 Process YouTube videos/playlists and save as chaptered MP3s
-Uses archive file: %s
+Uses archive file: %s (change with --archive)
+
+Options:
+  --config PATH                 Config file (default %s)
+  -a, --batch-file FILE         Read items from FILE, one per line ("-" for stdin);
+                                may be repeated
+`, prog, prog, prog, prog, defaultArchivePath(), defaultConfigPath())
+
+	defaults := defaultConfig()
+	for _, s := range settings {
+		name := "--" + s.flagName()
+		if s.Short != "" {
+			name = "-" + s.Short + ", " + name
+		}
+		fmt.Printf("  %-29s %s (default %q)\n", name, s.Usage, s.get(defaults))
+	}
+
+	fmt.Printf(`
+Every option can also be set in the config file as key = value (e.g.
+audio_quality = "5") or in the environment as %sKEY (e.g. %sJOBS=2).
+Flags override the environment, which overrides the config file.
+
+Profiles are defined in [profile.NAME] sections of the config file with the
+keys extends, description, format, audio_format, audio_quality, args,
+output_template, playlist_template, chapter_template, postprocess,
+loudness_target, silence_threshold and fade_duration. See "config show"
+for the available ones.
+
+Output templates take yt-dlp fields like %%(title)s plus our own {run_date},
+{profile}, {item}, {playlist_index}, {playlist_count}, {playlist_title} and
+{playlist_id}. Tag templates take {title}, {section_title} (the chapter's
+title in split files), {uploader}, {track}, {tracks}, {year}, {upload_date},
+{url}, {id}, {profile}, {playlist_title} and {playlist_index}; a tag whose
+template uses an empty field is left out.
 
 Arguments:
   Accepts multiple YouTube URLs/IDs, playlist links, or search terms
-`, filepath.Base(os.Args[0]), archiveFilename)
+  Prefix an item with a profile name to override --profile for it,
+  e.g. video-720p:https://youtu.be/ID
+  "-" reads items from stdin; they start as soon as each line arrives.
+
+Batch files and stdin take one item per line. Blank lines and # comments
+are ignored, and a line may end with options:
+  [PROFILE:]URL [profile=NAME] [dir=SUBDIR] [chapters=FILE]
+A chapter file has one "[H:]MM:SS Title" line per chapter and replaces the
+video's own chapters.
+
+Profiles with the split-chapters step handle chapters per chapter_mode:
+split keeps one file per chapter, whole keeps the downloaded file, both
+keeps all of them and cue keeps the whole file with a .cue sheet. A video
+without chapters counts as a single chapter, so it lands in the same
+layout. Chapter files are named by chapter_template, relative to the
+downloaded file's directory. It also takes %%(section_title)s,
+%%(section_number)s, %%(section_start)s and %%(section_end)s.
+
+Profiles may also list local audio steps, run after yt-dlp and chapter
+splitting on every media file, apart from the download workers and at
+most audio_jobs files at a time: normalize (two-pass EBU R128 loudnorm
+to loudness_target, re-encodes) or replaygain (ReplayGain tags only),
+trim-silence (cuts leading and trailing audio below silence_threshold)
+and fade (fade_duration in and out).
+
+Chapter files get a playlist next to them, named after the video, and each
+expanded playlist gets one in the directory holding all of its files,
+ordered by playlist index. playlist_format picks m3u8, pls or xspf; paths
+in them are relative, so the folder can be moved as a whole.
+
+Exit codes:
+  0    every item succeeded or was skipped
+  1    some items failed
+  2    every item failed
+  3    config, usage or setup error
+  4    yt-dlp, ffmpeg or ffprobe is missing or too old (see "doctor")
+  130  interrupted
+  With --fail-on-skip, skipped items count as failed.
+`, envPrefix, envPrefix)
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// playlistInfo identifies the playlist an expanded item came from.
+type playlistInfo struct {
+	Key        string
+	Identifier string
+	Title      string
+	Count      int
+}
+
+// playlistTally accumulates per-playlist outcomes for the summary.
+type playlistTally struct {
+	Info       *playlistInfo
+	Processed  int
+	Skipped    int
+	Failed     int
+	NotStarted int
+	Entries    []playlistEntry // for the playlist file
+}
+
+// playlistEntry is what one video of a playlist contributes to its
+// playlist file.
+type playlistEntry struct {
+	Index  int
+	Tracks []playlistTrack
+}
+
+var (
+	playlistTallies = make(map[string]*playlistTally)
+	playlistOrder   []string
+)
+
+type flatPlaylist struct {
+	ID      string `json:"id"`
+	Title   string `json:"title"`
+	Entries []struct {
+		Type  string `json:"_type"`
+		IEKey string `json:"ie_key"`
+		ID    string `json:"id"`
+		URL   string `json:"url"`
+		Title string `json:"title"`
+	} `json:"entries"`
+}
+
+func isPlaylistKey(key string) bool {
+	return strings.HasPrefix(key, playlistKeyPrefix)
+}
+
+// archivedPlaylist reports whether item, a playlist, is archived as a
+// whole, as legacy watch?v=...&list=... lines are once migrated. Its videos
+// were never recorded one by one, so expanding it would download them all
+// again; it is left unexpanded and skipped as archived instead.
+func archivedPlaylist(cfg *Config, item workItem) bool {
+	if cfg.NoArchive || !processedArchive.has(item.Key) {
+		return false
+	}
+	log.Printf("WARN: playlist %s is archived as a whole, not expanding it; remove it with \"archive rm %s\" to fetch videos added since", item.Identifier, item.Key)
+	return true
+}
+
+// expandPlaylist lists a playlist with yt-dlp --flat-playlist and returns
+// one work item per video, each inheriting the playlist item's options.
+func expandPlaylist(ctx context.Context, item workItem) ([]workItem, error) {
+	cmd := exec.CommandContext(ctx, "yt-dlp", "--flat-playlist", "-J", "--no-warnings", item.Identifier)
+	configureChildProcess(cmd)
+
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			if msg := lastLine(string(exitErr.Stderr)); msg != "" {
+				return nil, fmt.Errorf("playlist expansion failed: %s", msg)
+			}
+		}
+		return nil, fmt.Errorf("playlist expansion failed: %w", err)
+	}
+
+	var flat flatPlaylist
+	if err := json.Unmarshal(out, &flat); err != nil {
+		return nil, fmt.Errorf("playlist expansion: bad yt-dlp output: %w", err)
+	}
+
+	info := &playlistInfo{
+		Key:        item.Key,
+		Identifier: item.Identifier,
+		Title:      flat.Title,
+	}
+
+	videos := make([]workItem, 0, len(flat.Entries))
+	for _, entry := range flat.Entries {
+		if entry.Type == "playlist" || entry.ID == "" {
+			continue
+		}
+		identifier := entry.URL
+		if identifier == "" || entry.IEKey == "Youtube" {
+			identifier = "https://www.youtube.com/watch?v=" + entry.ID
+		}
+		videos = append(videos, workItem{
+			Identifier:    identifier,
+			Key:           canonicalKey(identifier),
+			Title:         entry.Title,
+			Profile:       item.Profile,
+			Subdir:        item.Subdir,
+			Playlist:      info,
+			PlaylistIndex: len(videos) + 1,
+		})
+	}
+	info.Count = len(videos)
+	return videos, nil
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// tallyPlaylistResult counts a result towards its playlist's summary line.
+// Like handleProcessingResult it only runs on the main goroutine.
+func tallyPlaylistResult(result processingResult, outcome string) {
+	if result.Playlist == nil {
+		return
+	}
+	tally, ok := playlistTallies[result.Playlist.Key]
+	if !ok {
+		tally = &playlistTally{Info: result.Playlist}
+		playlistTallies[result.Playlist.Key] = tally
+		playlistOrder = append(playlistOrder, result.Playlist.Key)
+	}
+
+	switch outcome {
+	case statusProcessed:
+		tally.Processed++
+		tally.Entries = append(tally.Entries, playlistEntry{Index: result.PlaylistIndex, Tracks: result.Tracks})
+	case statusSkipped:
+		tally.Skipped++
+		tally.Entries = append(tally.Entries, playlistEntry{Index: result.PlaylistIndex, Tracks: archivedTracks(result.Key)})
+	case statusNotStarted:
+		tally.NotStarted++
+	default:
+		tally.Failed++
+	}
+}
+
+func printPlaylistSummary() {
+	if len(playlistOrder) == 0 {
+		return
+	}
+
+	fmt.Println("  Playlists:")
+	for _, key := range playlistOrder {
+		t := playlistTallies[key]
+		title := t.Info.Title
+		if title == "" {
+			title = t.Info.Identifier
+		}
+		fmt.Printf("    %s (%d videos)\n", title, t.Info.Count)
+		fmt.Printf("      processed %d, skipped %d, failed %d", t.Processed, t.Skipped, t.Failed)
+		if t.NotStarted > 0 {
+			fmt.Printf(", not started %d", t.NotStarted)
+		}
+		fmt.Println()
+	}
+}
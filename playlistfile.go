@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Playlist file formats.
+const (
+	formatM3U8 = "m3u8"
+	formatPLS  = "pls"
+	formatXSPF = "xspf"
+	formatNone = "none"
+)
+
+// sidecarExts are files we write next to the media, which never belong in
+// a playlist.
+var sidecarExts = []string{".cue", ".m3u8", ".m3u", ".pls", ".xspf"}
+
+// playlistTrack is one entry of a playlist file.
+type playlistTrack struct {
+	Path     string
+	Title    string
+	Artist   string
+	Duration float64 // seconds, 0 if unknown
+}
+
+func checkPlaylistFormat(cfg *Config) error {
+	switch cfg.PlaylistFormat {
+	case formatM3U8, formatPLS, formatXSPF, formatNone:
+		return nil
+	}
+	return fmt.Errorf("playlist_format: expected m3u8, pls, xspf or none, got %q", cfg.PlaylistFormat)
+}
+
+// itemTracks lists the files of an item in play order: the chapter files
+// if it has any, else the whole file.
+func itemTracks(info *mediaInfo, files []outputFile) []playlistTrack {
+	chapters := slices.ContainsFunc(files, func(f outputFile) bool { return f.Track > 0 })
+	var tracks []playlistTrack
+	for _, f := range files {
+		if chapters && f.Track == 0 {
+			continue
+		}
+		t := playlistTrack{Path: f.Path, Duration: f.Duration}
+		if info != nil {
+			t.Title, t.Artist = info.Title, info.Uploader
+		}
+		if f.Chapter != nil && f.Chapter.Title != "" {
+			t.Title = f.Chapter.Title
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks
+}
+
+// writeItemPlaylist writes a playlist of item's chapter files next to
+// them, named after the video. Items without chapter files get none.
+func writeItemPlaylist(cfg *Config, info *mediaInfo, files []outputFile) (outputFile, bool, error) {
+	if cfg.PlaylistFormat == formatNone || info == nil || !slices.ContainsFunc(files, func(f outputFile) bool { return f.Track > 0 }) {
+		return outputFile{}, false, nil
+	}
+	tracks := itemTracks(info, files)
+	name := sanitizeFilename(info.Title, cfg.WindowsFilenames, cfg.MaxFilenameLength) + "." + cfg.PlaylistFormat
+	path := filepath.Join(filepath.Dir(tracks[0].Path), name)
+	if err := writePlaylistFile(path, cfg.PlaylistFormat, info.Title, tracks); err != nil {
+		return outputFile{}, false, fmt.Errorf("playlist file: %w", err)
+	}
+	return outputFile{Path: path}, true, nil
+}
+
+// writeYouTubePlaylists writes one playlist file per expanded playlist,
+// ordered by playlist index, in the deepest directory holding all of its
+// files. Items skipped as archived contribute the files the archive
+// recorded for them; an existing file is left alone if no item was
+// processed in this run. Like tallyPlaylistResult it only runs on the main
+// goroutine.
+func writeYouTubePlaylists(cfg *Config) {
+	if cfg.PlaylistFormat == formatNone {
+		return
+	}
+	for _, key := range playlistOrder {
+		t := playlistTallies[key]
+		entries := slices.Clone(t.Entries)
+		slices.SortStableFunc(entries, func(a, b playlistEntry) int { return a.Index - b.Index })
+
+		var tracks []playlistTrack
+		for _, e := range entries {
+			tracks = append(tracks, e.Tracks...)
+		}
+		if len(tracks) == 0 {
+			continue
+		}
+
+		title := t.Info.Title
+		if title == "" {
+			title = shortID(t.Info.Key)
+		}
+		dirs := make([]string, len(tracks))
+		for i, track := range tracks {
+			dirs[i] = filepath.Dir(track.Path)
+		}
+		name := sanitizeFilename(title, cfg.WindowsFilenames, cfg.MaxFilenameLength) + "." + cfg.PlaylistFormat
+		path := filepath.Join(commonDir(dirs), name)
+		if t.Processed == 0 {
+			// Archived items only know their paths, so a file from the run
+			// that downloaded them is better than what we could write now.
+			if _, err := os.Stat(path); err == nil {
+				continue
+			}
+		}
+		if err := writePlaylistFile(path, cfg.PlaylistFormat, title, tracks); err != nil {
+			log.Printf("WARN: playlist file for %s: %v", t.Info.Identifier, err)
+			continue
+		}
+		log.Printf("Wrote playlist %s (%d tracks)", path, len(tracks))
+	}
+}
+
+// archivedTracks lists the media files the archive recorded for key that
+// are still there. As in itemTracks, chapter files stand in for the whole
+// file kept next to them.
+func archivedTracks(key string) []playlistTrack {
+	files := processedArchive.files(key)
+	chapters := slices.ContainsFunc(files, func(f archiveFile) bool { return f.Track > 0 })
+	var tracks []playlistTrack
+	for _, f := range files {
+		if chapters && f.Track == 0 {
+			continue
+		}
+		if slices.Contains(sidecarExts, strings.ToLower(filepath.Ext(f.Path))) {
+			continue
+		}
+		if _, err := os.Stat(f.Path); err != nil {
+			continue
+		}
+		title := strings.TrimSuffix(filepath.Base(f.Path), filepath.Ext(f.Path))
+		tracks = append(tracks, playlistTrack{Path: f.Path, Title: title})
+	}
+	return tracks
+}
+
+// commonDir is the deepest directory containing every one of dirs.
+func commonDir(dirs []string) string {
+	common := dirs[0]
+	for _, dir := range dirs[1:] {
+		for common != dir && !strings.HasPrefix(dir, common+string(filepath.Separator)) {
+			parent := filepath.Dir(common)
+			if parent == common {
+				break
+			}
+			common = parent
+		}
+	}
+	return common
+}
+
+// writePlaylistFile writes tracks to path in format. Track paths are made
+// relative to the playlist, with forward slashes, so the folder can be
+// moved or copied to another machine as a whole.
+func writePlaylistFile(path, format, title string, tracks []playlistTrack) error {
+	dir := filepath.Dir(path)
+	rel := make([]string, len(tracks))
+	for i, t := range tracks {
+		abs, err := filepath.Abs(t.Path)
+		if err != nil {
+			return err
+		}
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		r, err := filepath.Rel(absDir, abs)
+		if err != nil {
+			return err
+		}
+		rel[i] = filepath.ToSlash(r)
+	}
+
+	var data []byte
+	switch format {
+	case formatM3U8:
+		data = []byte(formatM3U8Playlist(title, tracks, rel))
+	case formatPLS:
+		data = []byte(formatPLSPlaylist(tracks, rel))
+	case formatXSPF:
+		var err error
+		if data, err = formatXSPFPlaylist(title, tracks, rel); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// displayTitle is "Artist - Title", as players show in #EXTINF and PLS.
+func (t playlistTrack) displayTitle() string {
+	if t.Artist == "" {
+		return t.Title
+	}
+	return t.Artist + " - " + t.Title
+}
+
+// seconds is the whole-second length playlists take, -1 if unknown.
+func (t playlistTrack) seconds() int {
+	if t.Duration <= 0 {
+		return -1
+	}
+	return int(math.Round(t.Duration))
+}
+
+func formatM3U8Playlist(title string, tracks []playlistTrack, paths []string) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if title != "" {
+		fmt.Fprintf(&b, "#PLAYLIST:%s\n", oneLine(title))
+	}
+	for i, t := range tracks {
+		fmt.Fprintf(&b, "#EXTINF:%d,%s\n%s\n", t.seconds(), oneLine(t.displayTitle()), paths[i])
+	}
+	return b.String()
+}
+
+func formatPLSPlaylist(tracks []playlistTrack, paths []string) string {
+	var b strings.Builder
+	b.WriteString("[playlist]\n")
+	for i, t := range tracks {
+		fmt.Fprintf(&b, "File%d=%s\n", i+1, paths[i])
+		fmt.Fprintf(&b, "Title%d=%s\n", i+1, oneLine(t.displayTitle()))
+		fmt.Fprintf(&b, "Length%d=%d\n", i+1, t.seconds())
+	}
+	fmt.Fprintf(&b, "NumberOfEntries=%d\nVersion=2\n", len(tracks))
+	return b.String()
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Version string      `xml:"version,attr"`
+	XMLNS   string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	TrackNum int    `xml:"trackNum"`
+	Duration int64  `xml:"duration,omitempty"` // milliseconds
+}
+
+func formatXSPFPlaylist(title string, tracks []playlistTrack, paths []string) ([]byte, error) {
+	p := xspfPlaylist{Version: "1", XMLNS: "http://xspf.org/ns/0/", Title: title}
+	for i, t := range tracks {
+		// XSPF locations are URIs, so each path segment is escaped.
+		segments := strings.Split(paths[i], "/")
+		for j, s := range segments {
+			segments[j] = url.PathEscape(s)
+		}
+		p.Tracks = append(p.Tracks, xspfTrack{
+			Location: strings.Join(segments, "/"),
+			Title:    t.Title,
+			Creator:  t.Artist,
+			TrackNum: i + 1,
+			Duration: int64(math.Round(t.Duration * 1000)),
+		})
+	}
+	data, err := xml.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
+
+// oneLine keeps a title from breaking a line-based playlist format.
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
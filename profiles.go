@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultProfile = "audio-mp3"
+
+// Profile is a named download recipe: which streams yt-dlp fetches, what it
+// converts them to, where it writes them and which post-processing steps run.
+type Profile struct {
+	Name             string
+	Description      string
+	Format           string         // yt-dlp -f selector, "" for yt-dlp's default
+	AudioFormat      string         // extract audio in this format, "" keeps the video
+	AudioQuality     string         // overrides audio_quality when set
+	Args             []string       // extra yt-dlp arguments
+	OutputTemplate   string         // overrides output_template when set
+	PlaylistTemplate string         // overrides playlist_template when set
+	ChapterTemplate  string         // overrides chapter_template when set
+	PostProcess      []string       // steps from postProcessSteps
+	LoudnessTarget   *int           // overrides loudness_target when set
+	SilenceThreshold *int           // overrides silence_threshold when set
+	FadeDuration     *time.Duration // overrides fade_duration when set
+	Builtin          bool
+}
+
+// postProcessSteps maps the step names profiles can list to the yt-dlp
+// arguments that perform them. We split chapters ourselves, per
+// chapter_mode, and run the audio steps in audio.go ourselves too, so
+// those take none.
+var postProcessSteps = map[string][]string{
+	"split-chapters":  nil,
+	stepNormalize:     nil,
+	stepReplayGain:    nil,
+	stepTrimSilence:   nil,
+	stepFade:          nil,
+	"embed-thumbnail": {"--embed-thumbnail"},
+	"embed-metadata":  {"--embed-metadata"},
+	"embed-chapters":  {"--embed-chapters"},
+	"embed-subs":      {"--write-subs", "--embed-subs"},
+}
+
+func builtinProfiles() map[string]*Profile {
+	profiles := []*Profile{
+		{
+			Name:        "audio-mp3",
+			Description: "best audio as MP3, split by chapter, with cover art",
+			AudioFormat: "mp3",
+			PostProcess: []string{"split-chapters", "embed-thumbnail"},
+		},
+		{
+			Name:        "audio-opus",
+			Description: "best audio as Opus, split by chapter, with cover art",
+			Format:      "ba/b",
+			AudioFormat: "opus",
+			PostProcess: []string{"split-chapters", "embed-thumbnail"},
+		},
+		{
+			Name:        "video-best",
+			Description: "best video and audio merged into MKV",
+			Format:      "bv*+ba/b",
+			Args:        []string{"--merge-output-format", "mkv"},
+			PostProcess: []string{"embed-metadata", "embed-chapters", "embed-thumbnail", "embed-subs"},
+		},
+		{
+			Name:        "video-720p",
+			Description: "video up to 720p merged into MP4",
+			Format:      "bv*[height<=720]+ba/b[height<=720]",
+			Args:        []string{"--merge-output-format", "mp4"},
+			PostProcess: []string{"embed-metadata", "embed-chapters", "embed-thumbnail"},
+		},
+		{
+			Name:           "podcast",
+			Description:    "smaller MP3 kept whole, with chapters and metadata embedded",
+			Format:         "ba/b",
+			AudioFormat:    "mp3",
+			AudioQuality:   "5",
+			OutputTemplate: "%(uploader)s/%(upload_date)s - %(title)s.%(ext)s",
+			PostProcess:    []string{"embed-metadata", "embed-chapters", "embed-thumbnail"},
+		},
+	}
+
+	m := make(map[string]*Profile, len(profiles))
+	for _, p := range profiles {
+		p.Builtin = true
+		m[p.Name] = p
+	}
+	return m
+}
+
+// applyProfileValues turns [profile.NAME] sections of the config file into
+// profiles. A profile may start from another one with extends = "NAME";
+// otherwise it starts empty, or from the built-in of the same name.
+func applyProfileValues(profiles map[string]*Profile, values map[string]configValue) error {
+	byName := make(map[string]map[string]configValue)
+	for key, v := range values {
+		rest, ok := strings.CutPrefix(key, "profile.")
+		if !ok {
+			continue
+		}
+		name, field, ok := strings.Cut(rest, ".")
+		if !ok || name == "" {
+			return fmt.Errorf("line %d: profile settings belong in a [profile.NAME] section", v.Line)
+		}
+		if byName[name] == nil {
+			byName[name] = make(map[string]configValue)
+		}
+		byName[name][field] = v
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(byName)) {
+		if err := applyProfile(profiles, name, byName, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyProfile(profiles map[string]*Profile, name string, byName map[string]map[string]configValue, seen []string) error {
+	fields := byName[name]
+	if fields == nil {
+		return nil
+	}
+	if slices.Contains(seen, name) {
+		return fmt.Errorf("profile %q: extends loop (%s)", name, strings.Join(append(seen, name), " -> "))
+	}
+
+	// Redefining a built-in profile tweaks it rather than starting over.
+	parent := profiles[name]
+	if base, ok := fields["extends"]; ok && base.Str != name {
+		if err := applyProfile(profiles, base.Str, byName, append(seen, name)); err != nil {
+			return err
+		}
+		if parent, ok = profiles[base.Str]; !ok {
+			return fmt.Errorf("line %d: profile %q extends unknown profile %q", base.Line, name, base.Str)
+		}
+	}
+
+	p := &Profile{Name: name}
+	if parent != nil {
+		*p = *parent
+		p.Name = name
+		p.Args = slices.Clone(parent.Args)
+		p.PostProcess = slices.Clone(parent.PostProcess)
+	}
+	p.Builtin = false
+
+	for _, field := range slices.Sorted(maps.Keys(fields)) {
+		v := fields[field]
+		var err error
+		switch field {
+		case "extends":
+		case "description":
+			p.Description, err = v.scalar(field)
+		case "format":
+			p.Format, err = v.scalar(field)
+		case "audio_format":
+			p.AudioFormat, err = v.scalar(field)
+		case "audio_quality":
+			p.AudioQuality, err = v.scalar(field)
+		case "output_template":
+			p.OutputTemplate, err = v.scalar(field)
+		case "playlist_template":
+			p.PlaylistTemplate, err = v.scalar(field)
+		case "chapter_template":
+			p.ChapterTemplate, err = v.scalar(field)
+		case "args":
+			p.Args, err = v.list(field)
+		case "postprocess":
+			p.PostProcess, err = v.list(field)
+		case "loudness_target":
+			p.LoudnessTarget, err = v.integer(field)
+		case "silence_threshold":
+			p.SilenceThreshold, err = v.integer(field)
+		case "fade_duration":
+			p.FadeDuration, err = v.duration(field)
+		default:
+			err = fmt.Errorf("unknown profile setting %q", field)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: profile %q: %w", v.Line, name, err)
+		}
+	}
+
+	for _, step := range p.PostProcess {
+		if _, ok := postProcessSteps[step]; !ok {
+			return fmt.Errorf("profile %q: unknown post-processing step %q", name, step)
+		}
+	}
+
+	profiles[name] = p
+	delete(byName, name)
+	return nil
+}
+
+func (v configValue) scalar(key string) (string, error) {
+	if v.IsList {
+		return "", fmt.Errorf("%s does not take a list", key)
+	}
+	return v.Str, nil
+}
+
+func (v configValue) list(key string) ([]string, error) {
+	if !v.IsList {
+		return nil, fmt.Errorf("%s must be a list", key)
+	}
+	return v.List, nil
+}
+
+func (v configValue) integer(key string) (*int, error) {
+	s, err := v.scalar(key)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("%s: expected an integer, got %q", key, s)
+	}
+	return &n, nil
+}
+
+func (v configValue) duration(key string) (*time.Duration, error) {
+	s, err := v.scalar(key)
+	if err != nil {
+		return nil, err
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("%s: expected a duration such as 5s or 1m, got %q", key, s)
+	}
+	return &d, nil
+}
+
+// splitProfilePrefix recognizes a per-item "PROFILE:URL" prefix. Only known
+// profile names count, so "https:" and "ytsearch:" are left alone.
+func splitProfilePrefix(cfg *Config, arg string) (*Profile, string) {
+	if name, rest, ok := strings.Cut(arg, ":"); ok {
+		if p, ok := cfg.Profiles[name]; ok && rest != "" {
+			return p, rest
+		}
+	}
+	return cfg.Profiles[cfg.Profile], arg
+}
+
+func (p *Profile) hasStep(step string) bool {
+	return slices.Contains(p.PostProcess, step)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetries    = 3
+	defaultRetryDelay = 5 * time.Second
+	maxRetryDelay     = 5 * time.Minute
+	stderrTailSize    = 16 * 1024
+)
+
+// errorClass says why a yt-dlp run failed, and so whether retrying it can
+// help.
+type errorClass string
+
+const (
+	classNetwork     errorClass = "network"
+	classRateLimited errorClass = "rate-limited"
+	classGeoBlocked  errorClass = "geo-blocked"
+	classUnavailable errorClass = "unavailable"
+	classAgeGated    errorClass = "age-gated"
+	classFFmpeg      errorClass = "ffmpeg"
+	classUsage       errorClass = "usage"
+	// classVerification is set by us, not matched: yt-dlp succeeded but
+	// its output files failed verification.
+	classVerification errorClass = "verification"
+	classUnknown      errorClass = "unknown"
+)
+
+// errorPatterns are matched, in order, against the lower-cased tail of
+// yt-dlp's stderr. Specific causes come before the generic network ones,
+// since e.g. a 429 page also fails to "download webpage".
+var errorPatterns = []struct {
+	class    errorClass
+	patterns []string
+}{
+	{classRateLimited, []string{"http error 429", "too many requests", "rate-limit", "rate limit"}},
+	{classAgeGated, []string{"confirm your age", "age-restricted", "age restricted", "inappropriate for some users"}},
+	{classGeoBlocked, []string{"not available in your country", "made this video available in your country", "geo restriction", "geo-restricted", "geo restricted", "not available from your location", "blocked it in your country"}},
+	{classUnavailable, []string{"private video", "video unavailable", "has been removed", "account associated with this video has been terminated", "no longer available", "does not exist", "http error 404", "members-only", "join this channel"}},
+	{classFFmpeg, []string{"ffmpeg not found", "ffprobe not found", "postprocessing:", "conversion failed", "error opening output"}},
+	{classNetwork, []string{"timed out", "timeout", "connection reset", "connection refused", "connection aborted", "name resolution", "network is unreachable", "remote end closed", "incomplete read", "unable to download webpage", "unable to download video data", "http error 5", "eof occurred", "ssl", "errno 104"}},
+}
+
+// retries is how many times a failure of this class is retried, given the
+// configured budget. Network errors and rate limiting get all of it. An
+// error we don't recognize gets one retry: yt-dlp has transient failures
+// we have no pattern for, but a permanent one shouldn't sit through the
+// whole backoff schedule. The rest are permanent.
+func (c errorClass) retries(budget int) int {
+	switch c {
+	case classNetwork, classRateLimited:
+		return budget
+	case classUnknown:
+		return min(budget, 1)
+	}
+	return 0
+}
+
+// classifyFailure decides the error class from yt-dlp's exit status and the
+// tail of its stderr.
+func classifyFailure(err error, stderr string) errorClass {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+		return classUsage
+	}
+
+	lower := strings.ToLower(stderr)
+	for _, group := range errorPatterns {
+		for _, pattern := range group.patterns {
+			if strings.Contains(lower, pattern) {
+				return group.class
+			}
+		}
+	}
+	return classUnknown
+}
+
+// retryDelay is the jittered exponential backoff before the given retry
+// (1 for the first). Rate limiting backs off four times as hard.
+func retryDelay(base time.Duration, retry int, class errorClass) time.Duration {
+	if class == classRateLimited {
+		base *= 4
+	}
+	delay := base << (retry - 1)
+	if delay <= 0 || delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	// Equal jitter: at least half the delay, so retries stay spread out.
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// lastErrorLine picks the most recent "ERROR:" line yt-dlp printed, for a
+// failure message more useful than "exit status 1".
+func lastErrorLine(stderr string) string {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimSpace(lines[i]); strings.HasPrefix(line, "ERROR:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "ERROR:"))
+		}
+	}
+	return ""
+}
+
+// tailBuffer keeps the last stderrTailSize bytes written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - stderrTailSize; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
+
+func (t *tailBuffer) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = t.buf[:0]
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	// Error lines as yt-dlp prints them.
+	tests := []struct {
+		stderr string
+		want   errorClass
+	}{
+		{"ERROR: [youtube] h8htSF9X5sE: Unable to download webpage: HTTP Error 429: Too Many Requests (caused by <HTTPError 429: Too Many Requests>)", classRateLimited},
+		{"ERROR: [youtube] h8htSF9X5sE: Sign in to confirm your age. This video may be inappropriate for some users. Use --cookies-from-browser or --cookies for the authentication.", classAgeGated},
+		{"ERROR: [youtube] h8htSF9X5sE: Video unavailable. The uploader has not made this video available in your country", classGeoBlocked},
+		{"ERROR: [BBC] p0bnkn2k: This video is not available from your location due to geo restriction", classGeoBlocked},
+		{"ERROR: [youtube] h8htSF9X5sE: Private video. Sign in if you've been granted access to this video", classUnavailable},
+		{"ERROR: [youtube] h8htSF9X5sE: Video unavailable. This video has been removed by the uploader", classUnavailable},
+		{"ERROR: [youtube] h8htSF9X5sE: Join this channel to get access to members-only content like this video, and other exclusive perks.", classUnavailable},
+		{"ERROR: Postprocessing: ffprobe and ffmpeg not found. Please install or provide the path using --ffmpeg-location", classFFmpeg},
+		{"ERROR: Postprocessing: Conversion failed!", classFFmpeg},
+		{"ERROR: [download] Got error: The read operation timed out", classNetwork},
+		{"ERROR: [youtube] h8htSF9X5sE: Unable to download webpage: <urlopen error [Errno -3] Temporary failure in name resolution> (caused by TransportError('<urlopen error [Errno -3] Temporary failure in name resolution>'))", classNetwork},
+		{"ERROR: unable to download video data: HTTP Error 503: Service Unavailable", classNetwork},
+		{"ERROR: [download] Got error: [Errno 104] Connection reset by peer", classNetwork},
+		{"ERROR: 'not-a-url' is not a valid URL. Set --default-search \"ytsearch\" (or run  yt-dlp \"ytsearch:not-a-url\" ) to search YouTube", classUnknown},
+	}
+	for _, tt := range tests {
+		if got := classifyFailure(errors.New("exit status 1"), tt.stderr); got != tt.want {
+			t.Errorf("classifyFailure(%q) = %s, want %s", tt.stderr, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyFailureUsage(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to exit with status 2")
+	}
+	err := exec.Command("sh", "-c", "exit 2").Run()
+	if got := classifyFailure(err, "yt-dlp: error: no such option: --bogus"); got != classUsage {
+		t.Errorf("classifyFailure(exit 2) = %s, want %s", got, classUsage)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		class errorClass
+		want  int
+	}{
+		{classNetwork, 3},
+		{classRateLimited, 3},
+		{classUnknown, 1},
+		{classUnavailable, 0},
+		{classGeoBlocked, 0},
+		{classAgeGated, 0},
+		{classFFmpeg, 0},
+		{classUsage, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.class.retries(3); got != tt.want {
+			t.Errorf("%s.retries(3) = %d, want %d", tt.class, got, tt.want)
+		}
+	}
+	if got := classUnknown.retries(0); got != 0 {
+		t.Errorf("unknown.retries(0) = %d, want 0", got)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	base := 5 * time.Second
+	tests := []struct {
+		retry    int
+		class    errorClass
+		min, max time.Duration
+	}{
+		{1, classNetwork, 2500 * time.Millisecond, 5 * time.Second},
+		{3, classNetwork, 10 * time.Second, 20 * time.Second},
+		{1, classRateLimited, 10 * time.Second, 20 * time.Second},
+		{20, classNetwork, maxRetryDelay / 2, maxRetryDelay},
+		{70, classNetwork, maxRetryDelay / 2, maxRetryDelay},
+	}
+	for _, tt := range tests {
+		for range 50 {
+			if got := retryDelay(base, tt.retry, tt.class); got < tt.min || got > tt.max {
+				t.Errorf("retryDelay(%s, %d, %s) = %s, want %s to %s", base, tt.retry, tt.class, got, tt.min, tt.max)
+				break
+			}
+		}
+	}
+}
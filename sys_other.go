@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+func configureChildProcess(cmd *exec.Cmd) {}
+
+// lockFile only opens path here: without flock, archive and claim locking
+// protect a single process.
+func lockFile(path string, wait bool) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+}
@@ -0,0 +1,49 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// configureChildProcess puts the child in its own process group so a
+// terminal Ctrl-C only reaches us, and makes cancellation kill the whole
+// group (yt-dlp and the ffmpeg processes it spawns).
+func configureChildProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// lockFile opens path, creating it if needed, and takes an exclusive flock
+// on it. With wait false it fails with errLocked instead of blocking. The
+// lock is released when the file is closed, or by the kernel if the process
+// dies, so a crashed run never leaves a lock behind.
+func lockFile(path string, wait bool) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	for {
+		err = syscall.Flock(int(file.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	return file, nil
+}
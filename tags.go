@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const tagTimeout = 2 * time.Minute
+
+// tagKeys are the tags we write, in ffmpeg's generic names. ffmpeg maps
+// them to ID3v2 frames (TIT2, TALB, TPE1, TRCK, TDRC, COMM), Vorbis
+// comments (TITLE, ALBUM, ARTIST, TRACKNUMBER, DATE, DESCRIPTION) and MP4
+// atoms (©nam, ©alb, ©ART, trkn, ©day, ©cmt), so one set of templates
+// covers every container.
+var tagKeys = []struct {
+	Key      string
+	template func(*Config) string
+}{
+	{"title", func(c *Config) string { return c.TagTitle }},
+	{"album", func(c *Config) string { return c.TagAlbum }},
+	{"artist", func(c *Config) string { return c.TagArtist }},
+	{"track", func(c *Config) string { return c.TagTrack }},
+	{"date", func(c *Config) string { return c.TagDate }},
+	{"comment", func(c *Config) string { return c.TagComment }},
+}
+
+// tagFields are the {fields} tag templates can use.
+var tagFields = map[string]func(info *mediaInfo, f outputFile, item workItem) string{
+	"title":    func(info *mediaInfo, f outputFile, item workItem) string { return info.Title },
+	"uploader": func(info *mediaInfo, f outputFile, item workItem) string { return info.Uploader },
+	"id":       func(info *mediaInfo, f outputFile, item workItem) string { return info.ID },
+	"url":      func(info *mediaInfo, f outputFile, item workItem) string { return info.WebpageURL },
+	"profile":  func(info *mediaInfo, f outputFile, item workItem) string { return item.Profile.Name },
+	// section_title is the chapter's title in a split file and the video
+	// title in a whole one.
+	"section_title": func(info *mediaInfo, f outputFile, item workItem) string {
+		if f.Chapter != nil && f.Chapter.Title != "" {
+			return f.Chapter.Title
+		}
+		return info.Title
+	},
+	"track": func(info *mediaInfo, f outputFile, item workItem) string {
+		if f.Track == 0 {
+			return ""
+		}
+		return strconv.Itoa(f.Track)
+	},
+	"tracks": func(info *mediaInfo, f outputFile, item workItem) string {
+		if f.Tracks == 0 {
+			return ""
+		}
+		return strconv.Itoa(f.Tracks)
+	},
+	"year": func(info *mediaInfo, f outputFile, item workItem) string {
+		if len(info.UploadDate) < 4 {
+			return ""
+		}
+		return info.UploadDate[:4]
+	},
+	"upload_date": func(info *mediaInfo, f outputFile, item workItem) string {
+		if t, err := time.Parse("20060102", info.UploadDate); err == nil {
+			return t.Format("2006-01-02")
+		}
+		return ""
+	},
+	"playlist_title": func(info *mediaInfo, f outputFile, item workItem) string {
+		if item.Playlist == nil {
+			return ""
+		}
+		return item.Playlist.Title
+	},
+	"playlist_index": func(info *mediaInfo, f outputFile, item workItem) string {
+		if item.Playlist == nil {
+			return ""
+		}
+		return strconv.Itoa(item.PlaylistIndex)
+	},
+}
+
+func checkTagTemplates(cfg *Config) error {
+	for _, tag := range tagKeys {
+		for _, m := range templateField.FindAllStringSubmatch(tag.template(cfg), -1) {
+			if _, ok := tagFields[m[1]]; !ok {
+				return fmt.Errorf("tag_%s: unknown field {%s}", tag.Key, m[1])
+			}
+		}
+	}
+	return nil
+}
+
+// expandTag fills in a tag template. A template that refers to an empty
+// field yields "", so e.g. "{track}/{tracks}" is left out of whole files.
+func expandTag(tmpl string, info *mediaInfo, f outputFile, item workItem) string {
+	empty := false
+	value := templateField.ReplaceAllStringFunc(tmpl, func(field string) string {
+		v := tagFields[field[1:len(field)-1]](info, f, item)
+		if v == "" {
+			empty = true
+		}
+		return v
+	})
+	if empty {
+		return ""
+	}
+	return strings.TrimSpace(value)
+}
+
+// tagFiles writes the configured tags into each output file.
+func tagFiles(ctx context.Context, cfg *Config, item workItem, info *mediaInfo, files []outputFile) error {
+	for _, f := range files {
+		var metadata []string
+		for _, tag := range tagKeys {
+			if value := expandTag(tag.template(cfg), info, f, item); value != "" {
+				metadata = append(metadata, tag.Key+"="+value)
+			}
+		}
+		if len(metadata) == 0 {
+			continue
+		}
+		if err := writeTags(ctx, f.Path, metadata); err != nil {
+			return fmt.Errorf("tagging %s: %w", f.Path, err)
+		}
+	}
+	return nil
+}
+
+// writeTags remuxes path with ffmpeg, streams copied and existing tags and
+// cover art kept, adding metadata (key=value pairs). The result replaces
+// path only once ffmpeg has succeeded.
+func writeTags(ctx context.Context, path string, metadata []string) error {
+	ctx, cancel := context.WithTimeout(ctx, tagTimeout)
+	defer cancel()
+
+	// ffmpeg picks the muxer from the extension, so the temporary file
+	// keeps it.
+	tmp := filepath.Join(filepath.Dir(path), ".tagging-"+filepath.Base(path))
+	args := []string{"-nostdin", "-v", "error", "-y", "-i", path, "-map", "0", "-c", "copy", "-map_metadata", "0"}
+	if strings.EqualFold(filepath.Ext(path), ".mp3") {
+		args = append(args, "-id3v2_version", "4")
+	}
+	for _, kv := range metadata {
+		args = append(args, "-metadata", kv)
+	}
+	args = append(args, tmp)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	configureChildProcess(cmd)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			if msg := lastLine(string(out)); msg != "" {
+				return fmt.Errorf("ffmpeg: %s", msg)
+			}
+		}
+		return fmt.Errorf("ffmpeg: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
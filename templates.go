@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	defaultOutputTemplate    = "%(title)s [%(id)s].%(ext)s"
+	defaultPlaylistTemplate  = "{playlist_title}/{playlist_index} - %(title)s [%(id)s].%(ext)s"
+	defaultMaxFilenameLength = 200
+)
+
+// templateField matches our own {name} fields. yt-dlp's are %(name)s, so
+// the two never collide.
+var templateField = regexp.MustCompile(`\{(\w+)\}`)
+
+// templateFields are the fields we fill in before handing a template to
+// yt-dlp. Playlist fields are empty for items not from a playlist.
+var templateFields = map[string]func(cfg *Config, item workItem) string{
+	"run_date": func(cfg *Config, item workItem) string { return startTime.Format("2006-01-02") },
+	"profile":  func(cfg *Config, item workItem) string { return item.Profile.Name },
+	"item":     func(cfg *Config, item workItem) string { return strconv.Itoa(item.ItemNumber) },
+	"playlist_index": func(cfg *Config, item workItem) string {
+		if item.Playlist == nil {
+			return ""
+		}
+		width := len(strconv.Itoa(item.Playlist.Count))
+		return fmt.Sprintf("%0*d", width, item.PlaylistIndex)
+	},
+	"playlist_count": func(cfg *Config, item workItem) string {
+		if item.Playlist == nil {
+			return ""
+		}
+		return strconv.Itoa(item.Playlist.Count)
+	},
+	"playlist_title": func(cfg *Config, item workItem) string {
+		if item.Playlist == nil {
+			return ""
+		}
+		if item.Playlist.Title != "" {
+			return item.Playlist.Title
+		}
+		return shortID(item.Playlist.Key)
+	},
+	"playlist_id": func(cfg *Config, item workItem) string {
+		if item.Playlist == nil {
+			return ""
+		}
+		return shortID(item.Playlist.Key)
+	},
+}
+
+// checkTemplate rejects {fields} we don't know, so a typo fails at startup
+// instead of ending up in every file name.
+func checkTemplate(name, tmpl string) error {
+	for _, m := range templateField.FindAllStringSubmatch(tmpl, -1) {
+		if _, ok := templateFields[m[1]]; !ok {
+			return fmt.Errorf("%s: unknown field {%s}", name, m[1])
+		}
+	}
+	return nil
+}
+
+// checkTemplates validates the global templates and every profile's.
+func checkTemplates(cfg *Config) error {
+	templates := map[string]string{
+		"output_template":   cfg.OutputTemplate,
+		"playlist_template": cfg.PlaylistTemplate,
+		"chapter_template":  cfg.ChapterTemplate,
+	}
+	for _, p := range cfg.Profiles {
+		templates["profile "+p.Name+" output_template"] = p.OutputTemplate
+		templates["profile "+p.Name+" playlist_template"] = p.PlaylistTemplate
+		templates["profile "+p.Name+" chapter_template"] = p.ChapterTemplate
+	}
+	for name, tmpl := range templates {
+		if err := checkTemplate(name, tmpl); err != nil {
+			return err
+		}
+	}
+	if err := checkTagTemplates(cfg); err != nil {
+		return err
+	}
+	if cfg.MaxFilenameLength < 0 {
+		return fmt.Errorf("max_filename_length: must not be negative")
+	}
+	return nil
+}
+
+// expandTemplate fills in our fields, sanitized as file names and escaped
+// so yt-dlp leaves them alone, and joins the result to dir.
+func expandTemplate(cfg *Config, item workItem, dir, tmpl string) string {
+	expanded := templateField.ReplaceAllStringFunc(tmpl, func(field string) string {
+		value := templateFields[field[1:len(field)-1]](cfg, item)
+		if value == "" {
+			return ""
+		}
+		value = sanitizeFilename(value, cfg.WindowsFilenames, cfg.MaxFilenameLength)
+		return strings.ReplaceAll(value, "%", "%%")
+	})
+	return filepath.Join(dir, expanded)
+}
+
+// outputTemplates picks the main and chapter -o templates for item: a
+// playlist item uses the playlist template, anything else the output
+// template, profile values first.
+func outputTemplates(cfg *Config, item workItem) (main, chapter string) {
+	profile := item.Profile
+	pick := func(own, global string) string {
+		if own != "" {
+			return own
+		}
+		return global
+	}
+
+	if item.Playlist != nil {
+		main = pick(profile.PlaylistTemplate, cfg.PlaylistTemplate)
+	} else {
+		main = pick(profile.OutputTemplate, cfg.OutputTemplate)
+	}
+	return main, pick(profile.ChapterTemplate, cfg.ChapterTemplate)
+}
+
+// sanitizeFilename makes s usable as a single path component. With
+// windows set it also avoids what FAT and NTFS reject: reserved
+// characters, trailing dots and spaces, and device names like CON.
+// maxLen caps the length in bytes, 0 for no cap.
+func sanitizeFilename(s string, windows bool, maxLen int) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\' || r < 0x20 || r == 0x7f:
+			return '_'
+		case windows && strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, s)
+
+	if maxLen > 0 && len(s) > maxLen {
+		// Cut at a rune boundary, so a multi-byte character is dropped
+		// whole rather than split.
+		cut := maxLen
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		s = s[:cut]
+	}
+
+	if windows {
+		s = strings.TrimRight(s, ". ")
+		base, _, _ := strings.Cut(s, ".")
+		if isReservedWindowsName(base) {
+			s = "_" + s
+		}
+	}
+	if s == "" || s == "." || s == ".." {
+		s = "_"
+	}
+	return s
+}
+
+func isReservedWindowsName(name string) bool {
+	switch strings.ToUpper(strings.TrimSpace(name)) {
+	case "CON", "PRN", "AUX", "NUL",
+		"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+		"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9":
+		return true
+	}
+	return false
+}
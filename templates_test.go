@@ -0,0 +1,109 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		in      string
+		windows bool
+		maxLen  int
+		want    string
+	}{
+		{"AC/DC - Back in Black", false, 0, "AC_DC - Back in Black"},
+		{`a\b` + "\x00c\td", false, 0, "a_b_c_d"},
+		{`What? "Live": <1/2> | *`, false, 0, `What? "Live": <1_2> | *`},
+		{`What? "Live": <1/2> | *`, true, 0, `What_ _Live__ _1_2_ _ _`},
+		{"Trailing dots... ", true, 0, "Trailing dots"},
+		{"Trailing dots... ", false, 0, "Trailing dots... "},
+		{"CON", true, 0, "_CON"},
+		{"con.mp3", true, 0, "_con.mp3"},
+		{"lpt9.tar.gz", true, 0, "_lpt9.tar.gz"},
+		{"CONSOLE.mp3", true, 0, "CONSOLE.mp3"},
+		{"CON", false, 0, "CON"},
+		{"", false, 0, "_"},
+		{"..", false, 0, "_"},
+		{"...", true, 0, "_"},
+		{"abcdef", false, 4, "abcd"},
+		{"héllo", false, 2, "h"}, // é is two bytes, cut in the middle
+		{"日本語", false, 7, "日本"},  // three bytes each
+		{"日本語", false, 2, "_"},
+		{"\xffabc", false, 4, "\ufffda"}, // invalid bytes become U+FFFD, not an empty name
+	}
+	for _, tt := range tests {
+		if got := sanitizeFilename(tt.in, tt.windows, tt.maxLen); got != tt.want {
+			t.Errorf("sanitizeFilename(%q, %v, %d) = %q, want %q", tt.in, tt.windows, tt.maxLen, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	tests := []struct {
+		tmpl, err string
+	}{
+		{defaultOutputTemplate, ""},
+		{defaultPlaylistTemplate, ""},
+		{"{run_date}/{profile}/{item} %(title)s.%(ext)s", ""},
+		{"{playlist_id}/{playlist_count}/%(title)s.%(ext)s", ""},
+		{"{run-date}/%(title)s.%(ext)s", ""}, // not a field: \w only
+		{"{nope}/%(title)s.%(ext)s", "output_template: unknown field {nope}"},
+		{"{profile}/{Title}.%(ext)s", "output_template: unknown field {Title}"},
+	}
+	for _, tt := range tests {
+		err := checkTemplate("output_template", tt.tmpl)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("checkTemplate(%q) = %v, want nil", tt.tmpl, err)
+		case tt.err != "" && (err == nil || err.Error() != tt.err):
+			t.Errorf("checkTemplate(%q) = %v, want %q", tt.tmpl, err, tt.err)
+		}
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	saved := startTime
+	startTime = time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC)
+	defer func() { startTime = saved }()
+
+	cfg := &Config{WindowsFilenames: true}
+	profile := &Profile{Name: "audio-mp3"}
+	single := workItem{Profile: profile, ItemNumber: 7}
+	inPlaylist := workItem{
+		Profile:       profile,
+		ItemNumber:    8,
+		PlaylistIndex: 3,
+		Playlist:      &playlistInfo{Key: "youtube:playlist:PLabc", Title: "Best of: 100% / Live", Count: 120},
+	}
+	untitled := inPlaylist
+	untitled.Playlist = &playlistInfo{Key: "youtube:playlist:PLabc", Count: 9}
+
+	tests := []struct {
+		item       workItem
+		tmpl, want string
+	}{
+		{single, defaultOutputTemplate, "out/%(title)s [%(id)s].%(ext)s"},
+		{single, "{run_date}/{profile}-{item} %(title)s.%(ext)s", "out/2024-03-09/audio-mp3-7 %(title)s.%(ext)s"},
+		{single, "{playlist_title}/{playlist_index} - %(title)s.%(ext)s", "out/ - %(title)s.%(ext)s"},
+		{inPlaylist, defaultPlaylistTemplate, "out/Best of_ 100%% _ Live/003 - %(title)s [%(id)s].%(ext)s"},
+		{inPlaylist, "{playlist_id} {playlist_count}/%(title)s.%(ext)s", "out/PLabc 120/%(title)s.%(ext)s"},
+		{untitled, defaultPlaylistTemplate, "out/PLabc/3 - %(title)s [%(id)s].%(ext)s"},
+	}
+	for _, tt := range tests {
+		got := expandTemplate(cfg, tt.item, "out", tt.tmpl)
+		if want := filepath.FromSlash(tt.want); got != want {
+			t.Errorf("expandTemplate(%q) = %q, want %q", tt.tmpl, got, want)
+		}
+	}
+
+	// A long field is cut to max_filename_length.
+	cfg.MaxFilenameLength = 10
+	long := inPlaylist
+	long.Playlist = &playlistInfo{Key: "youtube:playlist:PLabc", Title: strings.Repeat("x", 50), Count: 120}
+	if got, want := expandTemplate(cfg, long, "out", "{playlist_title}/%(title)s"), filepath.Join("out", "xxxxxxxxxx", "%(title)s"); got != want {
+		t.Errorf("expandTemplate with max length = %q, want %q", got, want)
+	}
+}
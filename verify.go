@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errVerification marks an output that failed its checks, wherever in
+// the pipeline they ran.
+var errVerification = errors.New("verification failed")
+
+const (
+	defaultVerifyTolerance = 3 * time.Second
+	probeTimeout           = time.Minute
+)
+
+// infoTemplate makes yt-dlp write, once everything is in place, the final
+// file and the metadata we split and tag it with.
+const infoTemplate = "after_move:%(.{id,title,uploader,upload_date,duration,filepath,chapters,description,webpage_url})j"
+
+// mediaInfo is the line infoTemplate prints.
+type mediaInfo struct {
+	ID          string        `json:"id"`
+	Title       string        `json:"title"`
+	Uploader    string        `json:"uploader"`
+	UploadDate  string        `json:"upload_date"`
+	Duration    float64       `json:"duration"`
+	Filepath    string        `json:"filepath"`
+	Chapters    []chapterInfo `json:"chapters"`
+	Description string        `json:"description"`
+	WebpageURL  string        `json:"webpage_url"`
+}
+
+type chapterInfo struct {
+	Title     string  `json:"title"`
+	StartTime float64 `json:"start_time"`
+	EndTime   float64 `json:"end_time"`
+}
+
+// outputFile is a file the item produced, how long it should play and, for
+// chapter files, which chapter it holds.
+type outputFile struct {
+	Path     string
+	Duration float64 // seconds, 0 if unknown
+	Chapter  *chapterInfo
+	Track    int // 1-based position among the chapter files, 0 for the whole file
+	Tracks   int
+}
+
+// itemMedia is one video an item downloaded: its metadata, its media
+// files in play order, and the sidecars (cue sheet, playlist) made for it.
+type itemMedia struct {
+	info     *mediaInfo
+	files    []outputFile
+	sidecars []outputFile
+}
+
+// allFiles lists every file of media, sidecars after the media files of
+// each video.
+func allFiles(media []itemMedia) []outputFile {
+	var files []outputFile
+	for _, m := range media {
+		files = append(files, m.files...)
+		files = append(files, m.sidecars...)
+	}
+	return files
+}
+
+// audioCodecs maps --audio-format values to the codec ffprobe reports.
+var audioCodecs = map[string]string{
+	"mp3":    "mp3",
+	"opus":   "opus",
+	"vorbis": "vorbis",
+	"m4a":    "aac",
+	"aac":    "aac",
+	"flac":   "flac",
+	"alac":   "alac",
+	"wav":    "pcm_s16le",
+}
+
+// readMediaInfo parses what yt-dlp printed to path: a line per file it
+// produced, so several for a search, channel or playlist it expanded
+// itself.
+func readMediaInfo(path string) ([]*mediaInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var infos []*mediaInfo
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var info mediaInfo
+		if err := json.Unmarshal(line, &info); err != nil {
+			return nil, fmt.Errorf("bad yt-dlp file info on line %d: %w", i+1, err)
+		}
+		infos = append(infos, &info)
+	}
+	if len(infos) == 0 {
+		return nil, errors.New("yt-dlp reported no output files")
+	}
+	return infos, nil
+}
+
+// expectedFiles lists what yt-dlp should have produced: the whole file.
+// Chapter files are cut later, by applyChapterMode.
+func (m *mediaInfo) expectedFiles() ([]outputFile, error) {
+	if m.Filepath == "" {
+		return nil, errors.New("yt-dlp reported no output files")
+	}
+	return []outputFile{{Path: m.Filepath, Duration: m.Duration}}, nil
+}
+
+// verifyOutputs checks every file the item produced: it must exist, be
+// non-empty, probe as media with the codec the profile asked for, and
+// play about as long as the metadata says. It returns the files found,
+// even when some fail, with the durations of those that passed replaced
+// by what ffprobe measured.
+func verifyOutputs(ctx context.Context, cfg *Config, item workItem, files []outputFile) ([]outputFile, error) {
+	var found []outputFile
+	var problems []string
+	wantCodec := audioCodecs[item.Profile.AudioFormat]
+
+	for _, f := range files {
+		info, err := os.Stat(f.Path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: missing", f.Path))
+			continue
+		}
+		found = append(found, f)
+		if info.Size() == 0 {
+			problems = append(problems, fmt.Sprintf("%s: empty file", f.Path))
+			continue
+		}
+
+		duration, codecs, err := probeFile(ctx, f.Path)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s: %v", f.Path, err))
+		case wantCodec != "" && !slices.Contains(codecs, wantCodec):
+			problems = append(problems, fmt.Sprintf("%s: codec %s, expected %s", f.Path, strings.Join(codecs, "/"), wantCodec))
+		case f.Duration > 0 && math.Abs(duration-f.Duration) > tolerance(cfg, f.Duration):
+			problems = append(problems, fmt.Sprintf("%s: plays %.1fs, expected %.1fs", f.Path, duration, f.Duration))
+		default:
+			found[len(found)-1].Duration = duration
+		}
+	}
+
+	if len(problems) > 0 {
+		return found, fmt.Errorf("%w: %s", errVerification, strings.Join(problems, "; "))
+	}
+	return found, nil
+}
+
+// tolerance is how far a duration may be off: verify_tolerance, or 1% for
+// long files, since container durations are estimates.
+func tolerance(cfg *Config, expected float64) float64 {
+	return max(cfg.VerifyTolerance.Seconds(), expected/100)
+}
+
+type probeOutput struct {
+	Streams []struct {
+		CodecName string `json:"codec_name"`
+		CodecType string `json:"codec_type"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+// probeFile returns the duration of path in seconds and the codecs of its
+// audio streams, or of all streams for files without audio.
+func probeFile(ctx context.Context, path string) (float64, []string, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error",
+		"-show_entries", "format=duration:stream=codec_name,codec_type", "-of", "json", path)
+	configureChildProcess(cmd)
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			if msg := lastLine(string(exitErr.Stderr)); msg != "" {
+				return 0, nil, fmt.Errorf("ffprobe: %s", msg)
+			}
+		}
+		return 0, nil, fmt.Errorf("ffprobe: %w", err)
+	}
+
+	var probe probeOutput
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return 0, nil, fmt.Errorf("ffprobe: bad output: %w", err)
+	}
+	var audio, all []string
+	for _, s := range probe.Streams {
+		all = append(all, s.CodecName)
+		if s.CodecType == "audio" {
+			audio = append(audio, s.CodecName)
+		}
+	}
+	if len(all) == 0 {
+		return 0, nil, errors.New("no media streams")
+	}
+	if len(audio) == 0 {
+		audio = all
+	}
+	duration, err := strconv.ParseFloat(probe.Format.Duration, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("ffprobe: no duration")
+	}
+	return duration, audio, nil
+}
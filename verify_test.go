@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadMediaInfo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "info.json")
+	// What yt-dlp prints for a search that found two videos.
+	data := `{"id": "h8htSF9X5sE", "title": "First", "duration": 212.0, "filepath": "out/First [h8htSF9X5sE].mp3"}
+{"id": "pIwRg6rb1cI", "title": "Second", "duration": 187.5, "filepath": "out/Second [pIwRg6rb1cI].mp3"}
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := readMediaInfo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("got %d records, want 2", len(infos))
+	}
+	if infos[0].ID != "h8htSF9X5sE" || infos[1].Filepath != "out/Second [pIwRg6rb1cI].mp3" {
+		t.Errorf("got %+v, %+v", *infos[0], *infos[1])
+	}
+
+	for _, data := range []string{"", "\n\n", "{\"id\": \"h8htSF9X5sE\"}\nnot json\n"} {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readMediaInfo(path); err == nil {
+			t.Errorf("readMediaInfo(%q) succeeded, want an error", data)
+		}
+	}
+}